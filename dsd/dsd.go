@@ -4,8 +4,13 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
 
 	"github.com/davidmanzanares/dsd/dsdl"
+	"github.com/davidmanzanares/dsd/types"
 	"github.com/spf13/cobra"
 )
 
@@ -15,12 +20,15 @@ func main() {
 	rootCmd := &cobra.Command{Use: "dsd <command>"}
 
 	cmdAdd := &cobra.Command{
-		Use:   "add <target> <service> <pattern1> [patterns2]...",
+		Use:   "add [--entrypoint <path>] [--codec <codec>] [--blobs] <target> <service> <pattern1> [patterns2]...",
 		Short: "Add a new target to deploy",
 		Long:  `Adds a new target to deploy, a target is composed by its name, its service URL and a list of glob patterns.`,
 		Args:  cobra.MinimumNArgs(3),
 		Run: func(cmd *cobra.Command, args []string) {
-			target := dsdl.Target{Name: args[0], Service: args[1], Patterns: args[2:]}
+			entrypoint, _ := cmd.Flags().GetString("entrypoint")
+			codec, _ := cmd.Flags().GetString("codec")
+			blobs, _ := cmd.Flags().GetBool("blobs")
+			target := dsdl.Target{Name: args[0], Service: args[1], Patterns: args[2:], Entrypoint: entrypoint, Codec: codec, Blobs: blobs}
 			err := dsdl.AddTarget(target)
 			if err != nil {
 				log.Println(err)
@@ -28,10 +36,13 @@ func main() {
 			fmt.Printf("Target %s added\n", target)
 		},
 	}
+	cmdAdd.Flags().String("entrypoint", "", "Path of the program to run, the first deployed executable by default.")
+	cmdAdd.Flags().String("codec", "", "Compression of the archives: gzip, zstd or none, optionally followed by :<level>.")
+	cmdAdd.Flags().Bool("blobs", false, "If set, deploy every file as a content-addressed blob, only uploading the changed files.")
 	rootCmd.AddCommand(cmdAdd)
 
 	cmdDeploy := &cobra.Command{
-		Use:   "deploy <target>",
+		Use:   "deploy [-m <message>] [--meta <key>=<value>]... [--dry-run] [-q] <target>",
 		Short: "Deploys to <target>",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
@@ -40,40 +51,238 @@ func main() {
 				fmt.Printf("Target \"%s\" doesn't exist\n", args[0])
 				os.Exit(1)
 			}
+			if dryRun, _ := cmd.Flags().GetBool("dry-run"); dryRun {
+				plan, err := dsdl.DeployPlan(*target)
+				if err != nil {
+					log.Fatalln(err)
+				}
+				if len(plan.Platforms) == 0 {
+					printPlan(plan)
+					return
+				}
+				var platforms []string
+				for platform := range plan.Platforms {
+					platforms = append(platforms, platform)
+				}
+				sort.Strings(platforms)
+				for _, platform := range platforms {
+					fmt.Println("Platform", platform)
+					printPlan(plan.Platforms[platform])
+				}
+				fmt.Printf("%d platforms, about %d compressed bytes would be deployed\n", len(platforms), plan.EstimatedSize)
+				return
+			}
+			message, _ := cmd.Flags().GetString("message")
+			meta, _ := cmd.Flags().GetStringToString("meta")
+			if len(meta) == 0 {
+				meta = nil
+			}
+			quiet, _ := cmd.Flags().GetBool("quiet")
+			var last dsdl.Progress
+			progress := func(p dsdl.Progress) {
+				last = p
+				if !quiet {
+					printProgress(p)
+				}
+			}
 			fmt.Println("Deploying to", target)
-			v, err := dsdl.Deploy(*target)
+			v, err := dsdl.Deploy(*target, dsdl.DeployConf{Message: message, Meta: meta, Progress: progress})
+			if !quiet && last.Elapsed > 0 {
+				fmt.Fprintln(os.Stderr)
+			}
 			fmt.Println("Deployed ", v)
+			if last.Done {
+				printDeploySummary(last, v)
+			}
 			if err != nil {
 				log.Fatalln(err)
 			}
 		},
 	}
+	cmdDeploy.Flags().StringP("message", "m", "", "Message recorded in the deployed version.")
+	cmdDeploy.Flags().StringToString("meta", nil, "Metadata recorded in the deployed version, as <key>=<value>.")
+	cmdDeploy.Flags().Bool("dry-run", false, "If set, list the files which would be deployed without deploying them.")
+	cmdDeploy.Flags().BoolP("quiet", "q", false, "If set, don't print the progress bar.")
 	rootCmd.AddCommand(cmdDeploy)
 
 	cmdDownload := &cobra.Command{
-		Use:   "download <service>",
+		Use:   "download [--max-size <bytes>] [--max-files <n>] <service>",
 		Short: "Downloads the current deployment on <service>",
 		Args:  cobra.ExactArgs(1),
 		Run: func(cmd *cobra.Command, args []string) {
-			err := dsdl.Download(args[0])
+			err := dsdl.Download(args[0], getLimits(cmd))
 			if err != nil {
 				log.Fatalln(err)
 			}
 		},
 	}
+	addLimitsFlags(cmdDownload)
 	rootCmd.AddCommand(cmdDownload)
 
+	cmdVersions := &cobra.Command{
+		Use:   "versions <service>",
+		Short: "Lists the versions deployed on <service>",
+		Long:  `Lists the versions deployed on <service>, newest first. Services without history only list their current version.`,
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			versions, err := dsdl.Versions(args[0])
+			if err != nil {
+				log.Fatalln(err)
+			}
+			for _, v := range versions {
+				fmt.Println(formatVersion(v))
+			}
+		},
+	}
+	rootCmd.AddCommand(cmdVersions)
+
+	cmdGC := &cobra.Command{
+		Use:   "gc [--keep-last <n>] [--keep-newer-than <duration>] [--dry-run] <target>",
+		Short: "Deletes old archived versions from <target>",
+		Long: `Deletes the archived versions of <target> which aren't kept by the policy.` + "\n" +
+			`A version is kept if it's one of the last <n> versions, if it's newer than <duration>, or if it's the current version.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			target, ok := conf.Targets[args[0]]
+			if !ok {
+				fmt.Printf("Target \"%s\" doesn't exist\n", args[0])
+				os.Exit(1)
+			}
+			keepLast, _ := cmd.Flags().GetInt("keep-last")
+			keepNewerThan, _ := cmd.Flags().GetDuration("keep-newer-than")
+			dryRun, _ := cmd.Flags().GetBool("dry-run")
+
+			result, err := dsdl.GC(target.Service, dsdl.GCPolicy{KeepLast: keepLast, KeepNewerThan: keepNewerThan, DryRun: dryRun})
+			action := "Deleted"
+			if dryRun {
+				action = "Would delete"
+			}
+			for _, a := range result.Deleted {
+				fmt.Printf("%s %s (%d bytes, %s)\n", action, a.Name, a.Size, a.Time)
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+			if dryRun {
+				fmt.Printf("%d assets, %d bytes would be reclaimed\n", len(result.Deleted), result.Bytes)
+			} else {
+				fmt.Printf("%d assets, %d bytes reclaimed\n", len(result.Deleted), result.Bytes)
+			}
+		},
+	}
+	cmdGC.Flags().Int("keep-last", 10, "Number of most recent versions to keep.")
+	cmdGC.Flags().Duration("keep-newer-than", 0, "Keep versions newer than this duration (e.g. 720h).")
+	cmdGC.Flags().Bool("dry-run", false, "If set, list what would be deleted without deleting it.")
+	rootCmd.AddCommand(cmdGC)
+
+	cmdSync := &cobra.Command{
+		Use:   "sync [--version <version> | --all] [--set-current=false] <from-service> <to-service>",
+		Short: "Copies versions from <from-service> to <to-service>",
+		Long: `Copies versions from <from-service> to <to-service>, keeping their names and times.` + "\n" +
+			`The current version is copied by default, assets already stored on <to-service> aren't copied again.`,
+		Args: cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			version, _ := cmd.Flags().GetString("version")
+			all, _ := cmd.Flags().GetBool("all")
+			setCurrent, _ := cmd.Flags().GetBool("set-current")
+			result, err := dsdl.Sync(args[0], args[1], dsdl.SyncConf{Version: version, All: all, SetCurrent: setCurrent})
+			for _, a := range result.Assets {
+				fmt.Printf("Copied %s (%d bytes)\n", a.Name, a.Size)
+			}
+			for _, v := range result.Versions {
+				fmt.Println("Synced", v.Name, v.Time)
+			}
+			if err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+	cmdSync.Flags().String("version", "", "Name of the version to copy, the current version by default.")
+	cmdSync.Flags().Bool("all", false, "If set, copy every version of the source history.")
+	cmdSync.Flags().Bool("set-current", true, "Set the copied version as the current version of the destination.")
+	rootCmd.AddCommand(cmdSync)
+
+	cmdExport := &cobra.Command{
+		Use:   "export [--version <version>] -o <bundle> <service>",
+		Short: "Writes a version of <service> to a bundle file",
+		Long: `Writes a version of <service> and all its assets to a single bundle file, the current version by default.` + "\n" +
+			`Bundles can be imported to other services, or run directly with "run --bundle".`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			version, _ := cmd.Flags().GetString("version")
+			output, _ := cmd.Flags().GetString("output")
+			result, err := dsdl.Export(args[0], version, output)
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Printf("Exported %s to %s (%d bytes)\n", result.Versions[0].Name, output, result.Bytes)
+		},
+	}
+	cmdExport.Flags().String("version", "", "Name of the version to export, the current version by default.")
+	cmdExport.Flags().StringP("output", "o", "", "Bundle file to write.")
+	cmdExport.MarkFlagRequired("output")
+	rootCmd.AddCommand(cmdExport)
+
+	cmdImport := &cobra.Command{
+		Use:   "import <bundle> <service>",
+		Short: "Copies the version stored in <bundle> to <service>",
+		Long:  `Copies the version stored in <bundle> to <service>, making it its current version.`,
+		Args:  cobra.ExactArgs(2),
+		Run: func(cmd *cobra.Command, args []string) {
+			result, err := dsdl.Import(args[0], args[1])
+			if err != nil {
+				log.Fatalln(err)
+			}
+			fmt.Println("Imported", result.Versions[0].Name, result.Versions[0].Time)
+		},
+	}
+	rootCmd.AddCommand(cmdImport)
+
+	cmdServe := &cobra.Command{
+		Use:   "serve [--listen <address>] [--token <token>] [--upload-token <token>] <service>",
+		Short: "Exposes <service> over HTTP",
+		Long: `Exposes <service> over HTTP, allowing runners to use it as an http:// or https:// service.` + "\n" +
+			`Runners using it get notified of new versions immediately.` + "\n" +
+			`If an upload token is set, deploys can push through the server by setting it as their bearer token.`,
+		Args: cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			listen, _ := cmd.Flags().GetString("listen")
+			token, _ := cmd.Flags().GetString("token")
+			uploadToken, _ := cmd.Flags().GetString("upload-token")
+			tlsCert, _ := cmd.Flags().GetString("tls-cert")
+			tlsKey, _ := cmd.Flags().GetString("tls-key")
+			fmt.Println("Serving", dsdl.RedactService(args[0]), "on", listen)
+			err := dsdl.Serve(args[0], dsdl.ServeConf{Listen: listen, Token: token, UploadToken: uploadToken, TLSCert: tlsCert, TLSKey: tlsKey})
+			if err != nil {
+				log.Fatalln(err)
+			}
+		},
+	}
+	cmdServe.Flags().String("listen", ":8080", "Address to listen on.")
+	cmdServe.Flags().String("token", "", "If set, downloads require this bearer token.")
+	cmdServe.Flags().String("upload-token", "", "If set, uploads are accepted with this bearer token.")
+	cmdServe.Flags().String("tls-cert", "", "Certificate file, enables HTTPS.")
+	cmdServe.Flags().String("tls-key", "", "Certificate key file, enables HTTPS.")
+	rootCmd.AddCommand(cmdServe)
+
 	cmdRun := &cobra.Command{
-		Use:   "run [--hotreload] [--on-success <reaction>] [--on-failure <reaction>] <service>",
+		Use:   "run [--hotreload] [--max-size <bytes>] [--max-files <n>] [--on-success <reaction>] [--on-failure <reaction>] <service> | --bundle <bundle>",
 		Short: "Run the deployed application on the target service",
 		Long: `Run the deployed application on <service>, with the provided arguments.` + "\n" +
 			`Where <reaction> is one of "exit", "wait" or "restart".` + "\n\t" +
 			`"exit" will stop dsd's execution` + "\n\t" + `"wait" will wait for future updates (which will trigger an application start)` + "\n\t" +
-			`"restart" will restart the application immediately.`,
+			`"restart" will restart the application immediately.` + "\n" +
+			`With --bundle, the version stored in <bundle> is run and every argument is passed to the application.`,
 
-		Args: cobra.MinimumNArgs(1),
+		Args: func(cmd *cobra.Command, args []string) error {
+			if bundle, _ := cmd.Flags().GetString("bundle"); bundle != "" {
+				return nil
+			}
+			return cobra.MinimumNArgs(1)(cmd, args)
+		},
 		Run: func(cmd *cobra.Command, args []string) {
 			hotreload, _ := cmd.Flags().GetBool("hotreload")
+			bundle, _ := cmd.Flags().GetString("bundle")
 			onSuccess, _ := cmd.Flags().GetString("on-success")
 			onFailure, _ := cmd.Flags().GetString("on-failure")
 
@@ -87,11 +296,16 @@ func main() {
 				fmt.Println(err)
 				return
 			}
-			r, err := dsdl.Run(args[0], dsdl.RunConf{
+			service, appArgs := dsdl.BundleService(bundle), args
+			if bundle == "" {
+				service, appArgs = args[0], args[1:]
+			}
+			r, err := dsdl.Run(service, dsdl.RunConf{
 				HotReload: hotreload,
 				OnSuccess: successReaction,
 				OnFailure: failureReaction,
-				Args:      args[1:]})
+				Limits:    getLimits(cmd),
+				Args:      appArgs})
 			if err != nil {
 				fmt.Println(err)
 				return
@@ -107,8 +321,10 @@ func main() {
 		},
 	}
 	cmdRun.Flags().Bool("hotreload", false, "If set, the application will be stopped and restarted with future updates.")
+	cmdRun.Flags().String("bundle", "", "Bundle file to run instead of a service.")
 	cmdRun.Flags().String("on-success", "exit", `Reaction to application exits with a zero code.`)
 	cmdRun.Flags().String("on-failure", "exit", `Reaction to application exits with a non-zero code.`)
+	addLimitsFlags(cmdRun)
 	rootCmd.AddCommand(cmdRun)
 
 	rootCmd.Execute()
@@ -126,3 +342,128 @@ func getReaction(s string) (dsdl.RunReaction, error) {
 	}
 	return dsdl.Exit, fmt.Errorf(`invalid reaction (%s). Valid values are: "restart", "wait", "exit"`, s)
 }
+
+func addLimitsFlags(cmd *cobra.Command) {
+	cmd.Flags().Int64("max-size", dsdl.DefaultLimits.MaxSize, "Maximum uncompressed size of the downloaded archives, in bytes. Negative values disable the limit.")
+	cmd.Flags().Int("max-files", dsdl.DefaultLimits.MaxFiles, "Maximum number of files of the downloaded archives. Negative values disable the limit.")
+}
+
+func getLimits(cmd *cobra.Command) dsdl.Limits {
+	maxSize, _ := cmd.Flags().GetInt64("max-size")
+	maxFiles, _ := cmd.Flags().GetInt("max-files")
+	return dsdl.Limits{MaxSize: maxSize, MaxFiles: maxFiles}
+}
+
+// printPlan prints the files of the single archive plan
+func printPlan(plan dsdl.Plan) {
+	for _, f := range plan.Files {
+		executable := ""
+		if filepath.ToSlash(f.Name) == plan.Entrypoint {
+			executable = " (entrypoint)"
+		} else if f.Executable {
+			executable = " (executable)"
+		}
+		fmt.Printf("%s %10d %s%s\n", f.Mode, f.Size, f.Name, executable)
+	}
+	for _, p := range plan.UnmatchedPatterns {
+		fmt.Printf("Pattern %s didn't match any file\n", p)
+	}
+	fmt.Printf("%d files, %d executables, about %d compressed bytes would be deployed\n",
+		len(plan.Files), len(plan.Executables()), plan.EstimatedSize)
+}
+
+// printProgress renders the deploy progress bar on stderr, overwriting the previous one
+func printProgress(p dsdl.Progress) {
+	const width = 30
+	ratio := 1.0
+	if p.TotalBytes > 0 {
+		ratio = float64(p.Bytes) / float64(p.TotalBytes)
+	}
+	filled := int(ratio * width)
+	eta := "-"
+	if d := p.ETA(); d > 0 {
+		eta = d.Round(time.Second).String()
+	}
+	platform := ""
+	if p.Platform != "" {
+		platform = p.Platform + " "
+	}
+	fmt.Fprintf(os.Stderr, "\r%s[%s%s] %3.0f%% %d/%d files %s/%s, %s uploaded, %s/s, ETA %s\x1b[K",
+		platform, strings.Repeat("#", filled), strings.Repeat(" ", width-filled), ratio*100,
+		p.Files, p.TotalFiles, formatBytes(p.Bytes), formatBytes(p.TotalBytes),
+		formatBytes(p.Uploaded), formatBytes(int64(p.Throughput())), eta)
+}
+
+// printDeploySummary prints the stats of the deploy of v, p being its last progress report
+func printDeploySummary(p dsdl.Progress, v types.Version) {
+	ratio := 0.0
+	if p.TotalBytes > 0 {
+		ratio = float64(v.Size) / float64(p.TotalBytes)
+	}
+	fmt.Printf("%d files, %s read, %s compressed (%.1f%%) in %s\n",
+		v.Files, formatBytes(p.TotalBytes), formatBytes(v.Size), ratio*100, p.Elapsed.Round(time.Millisecond))
+}
+
+// formatBytes formats n with a binary unit
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// formatVersion formats v and the metadata it has in a single line
+func formatVersion(v types.Version) string {
+	s := fmt.Sprint(v.Name, " ", v.Time)
+	if v.User != "" || v.Hostname != "" {
+		s += fmt.Sprintf(" by %s@%s", v.User, v.Hostname)
+	}
+	if v.Git != nil {
+		commit := v.Git.Commit
+		if len(commit) > 12 {
+			commit = commit[:12]
+		}
+		s += " git:" + commit
+		if v.Git.Branch != "" {
+			s += "(" + v.Git.Branch + ")"
+		}
+		if v.Git.Dirty {
+			s += "+dirty"
+		}
+	}
+	if v.Files > 0 {
+		s += fmt.Sprintf(" %d files, %d bytes", v.Files, v.Size)
+	}
+	if v.Codec != "" {
+		s += " codec:" + v.Codec
+	}
+	if v.Blobs {
+		s += " blobs"
+	}
+	if len(v.Platforms) > 0 {
+		var platforms []string
+		for platform := range v.Platforms {
+			platforms = append(platforms, platform)
+		}
+		sort.Strings(platforms)
+		s += " platforms:" + strings.Join(platforms, ",")
+	}
+	if v.Message != "" {
+		s += fmt.Sprintf(" %q", v.Message)
+	}
+	keys := make([]string, 0, len(v.Meta))
+	for k := range v.Meta {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		s += fmt.Sprintf(" %s=%s", k, v.Meta[k])
+	}
+	return s
+}
@@ -0,0 +1,404 @@
+package dsdl
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/davidmanzanares/dsd/internal/fileio"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// blobsPrefix prefixes the asset names of the content-addressed blobs, followed by the SHA-256 of their content
+const blobsPrefix = "blobs/"
+
+// manifestExtension is the suffix of the manifests of blob versions, which replace their archives
+const manifestExtension = ".manifest.json"
+
+// localBlobsFolder keeps the downloaded blobs read-only, they are hard-linked or copied into the version folders
+var localBlobsFolder = filepath.Join(assetsFolder, ".blobs")
+
+// blobGracePeriod is the age under which GC keeps versions and unreferenced blobs, they may belong to a deploy in
+// progress
+const blobGracePeriod = time.Hour
+
+// manifest lists the files of a blob version archive
+type manifest struct {
+	Files []manifestFile
+}
+
+type manifestFile struct {
+	// Name is the slash separated path of the file
+	Name string
+	Mode os.FileMode
+	Size int64
+	// Blob is the hex SHA-256 of the file content
+	Blob string
+}
+
+// blobAsset returns the asset name of the blob with hash, compressed with c
+func blobAsset(hash string, c codec) string {
+	return blobsPrefix + hash + c.blobExtension
+}
+
+// blobHash returns the hash of the blob asset name, or an empty string if it isn't a blob
+func blobHash(name string) string {
+	if !strings.HasPrefix(name, blobsPrefix) {
+		return ""
+	}
+	return strings.SplitN(name[len(blobsPrefix):], ".", 2)[0]
+}
+
+// validBlob returns true if hash is a hex SHA-256, blob hashes are used in paths
+func validBlob(hash string) bool {
+	b, err := hex.DecodeString(hash)
+	return err == nil && len(b) == sha256.Size && strings.ToLower(hash) == hash
+}
+
+// storedBlobs returns the names of the blobs of p, it's empty if p can't list its assets
+func storedBlobs(p types.Provider) (map[string]bool, error) {
+	stored := make(map[string]bool)
+	m, ok := p.(types.AssetManager)
+	if !ok {
+		return stored, nil
+	}
+	assets, err := m.ListAssets()
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range assets {
+		if blobHash(a.Name) != "" {
+			stored[a.Name] = true
+		}
+	}
+	return stored, nil
+}
+
+// pushBlobs uploads the files of plan missing from stored as blobs compressed with c, and the manifest of plan
+// as the asset name, stored is updated with the uploaded blobs
+// The reused blobs are checked again once the manifest is pushed, GC may have deleted them before
+// It returns the uploaded bytes and the number of files
+func pushBlobs(p types.Provider, name, platform string, plan Plan, c compression, stored map[string]bool, progress *progressReporter) (int64, int, error) {
+	var m manifest
+	for _, planned := range plan.Files {
+		hash, err := hashFile(planned.Name)
+		if err != nil {
+			return 0, 0, err
+		}
+		mode := planned.Mode.Perm()
+		if strings.HasSuffix(planned.Name, ".exe") {
+			// Ensure .exe files are exeutable
+			mode |= 0100
+		}
+		m.Files = append(m.Files, manifestFile{Name: filepath.ToSlash(planned.Name), Mode: mode, Size: planned.Size, Blob: hash})
+	}
+
+	uploaded := &fileio.CountingWriter{}
+	progress.startArchive(platform, uploaded)
+	push := func(f manifestFile, progress *progressReporter) error {
+		saved, base := progress.save(), uploaded.N
+		return pushAsset(p, blobAsset(f.Blob, c.codec), func(w io.Writer) error {
+			// Retries write the blob again
+			progress.restore(saved)
+			uploaded.N = base
+			uploaded.W = w
+			return writeBlob(uploaded, filepath.FromSlash(f.Name), f.Blob, c, progress)
+		})
+	}
+	var reused []manifestFile
+	for _, f := range m.Files {
+		asset := blobAsset(f.Blob, c.codec)
+		if stored[asset] {
+			reused = append(reused, f)
+			progress.read(int(f.Size))
+			progress.fileDone()
+			continue
+		}
+		err := push(f, progress)
+		if err != nil {
+			return 0, 0, err
+		}
+		stored[asset] = true
+		progress.fileDone()
+	}
+
+	buff, err := json.Marshal(m)
+	if err != nil {
+		return 0, 0, err
+	}
+	base := uploaded.N
+	err = pushAsset(p, name, func(w io.Writer) error {
+		uploaded.N = base
+		uploaded.W = w
+		_, err := uploaded.Write(buff)
+		return err
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// GC keeps the blobs of recent manifests, the blobs found now can't be deleted before the version is pushed
+	// Services which can't list their assets can't be garbage collected either
+	if _, ok := p.(types.AssetManager); ok && len(reused) > 0 {
+		found, err := storedBlobs(p)
+		if err != nil {
+			return 0, 0, err
+		}
+		for _, f := range reused {
+			asset := blobAsset(f.Blob, c.codec)
+			if found[asset] {
+				continue
+			}
+			// Their read bytes were already reported
+			err = push(f, nil)
+			if err != nil {
+				return 0, 0, err
+			}
+			found[asset] = true
+		}
+	}
+	return uploaded.N, len(m.Files), nil
+}
+
+// writeBlob writes filename compressed with c to w, failing if its content doesn't match hash anymore
+func writeBlob(w io.Writer, filename, hash string, c compression, progress *progressReporter) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	compressorInput, err := c.codec.compress(w, c.level)
+	if err != nil {
+		return err
+	}
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(compressorInput, h), progressReader{r: f, reporter: progress})
+	if err != nil {
+		return err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return fmt.Errorf("File %s changed while deploying it", filename)
+	}
+	return compressorInput.Close()
+}
+
+func hashFile(filename string) (string, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// readManifest returns the manifest asset name of p
+func readManifest(p types.Provider, name string) (manifest, error) {
+	var buff bytes.Buffer
+	err := p.GetAsset(name, &buff)
+	if err != nil {
+		return manifest{}, err
+	}
+	var m manifest
+	err = json.Unmarshal(buff.Bytes(), &m)
+	if err != nil {
+		return manifest{}, fmt.Errorf("Invalid manifest %s: %w", name, err)
+	}
+	return m, nil
+}
+
+// extractBlobs writes the files of the manifest asset into folder, the blobs are compressed with c
+// Blobs downloaded by previous versions aren't downloaded again, every file is hard-linked from the local blobs
+// Writing to a shared file would modify the other versions, so the extracted files are read-only,
+// their write bits are cleared
+// It returns the names of the files recorded as executables in the manifest, in manifest order
+func extractBlobs(p types.Provider, asset string, c codec, folder string, limits Limits) ([]string, error) {
+	m, err := readManifest(p, asset)
+	if err != nil {
+		return nil, err
+	}
+	if limits.MaxFiles > 0 && len(m.Files) > limits.MaxFiles {
+		return nil, fmt.Errorf("Archive exceeds the limit of %d files", limits.MaxFiles)
+	}
+	var size int64
+	for _, f := range m.Files {
+		size += f.Size
+		if limits.MaxSize > 0 && size > limits.MaxSize {
+			return nil, fmt.Errorf("Archive exceeds the limit of %d uncompressed bytes", limits.MaxSize)
+		}
+	}
+	err = os.MkdirAll(localBlobsFolder, 0770)
+	if err != nil {
+		return nil, err
+	}
+
+	var executables []string
+	for _, f := range m.Files {
+		name, err := sanitizeName(f.Name)
+		if err != nil {
+			return nil, err
+		}
+		if name == "." || !validBlob(f.Blob) {
+			return nil, fmt.Errorf("Invalid manifest entry: %s %s", f.Name, f.Blob)
+		}
+		// Setuid, setgid and sticky bits are never restored
+		mode := f.Mode.Perm()
+		local, err := localBlob(p, f.Blob, f.Size, mode, c)
+		if err != nil {
+			return nil, err
+		}
+		filename := filepath.Join(folder, filepath.FromSlash(name))
+		err = os.MkdirAll(filepath.Dir(filename), 0770)
+		if err != nil {
+			return nil, err
+		}
+		os.Remove(filename)
+		err = linkFile(local, filename)
+		if err != nil {
+			return nil, err
+		}
+		if mode&0100 != 0 {
+			executables = append(executables, name)
+		}
+	}
+	syncDir(folder)
+	return executables, nil
+}
+
+// localBlob returns the path of the local copy of blob with mode, downloading it if it's missing or modified
+// Local blobs are read-only, their write bits are cleared
+func localBlob(p types.Provider, hash string, size int64, mode os.FileMode, c codec) (string, error) {
+	mode &^= 0222
+	local := filepath.Join(localBlobsFolder, fmt.Sprintf("%s-%o", hash, mode))
+	if fi, err := os.Stat(local); err == nil && fi.Size() == size {
+		// Hard-linked files can still be modified by their owner, like by root
+		if localHash, err := hashFile(local); err == nil && localHash == hash {
+			return local, nil
+		}
+	}
+	tmp, err := ioutil.TempFile(localBlobsFolder, partialPrefix)
+	if err != nil {
+		return "", err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	h := sha256.New()
+	err = readAsset(p, blobAsset(hash, c), func(r io.Reader) error {
+		decompressorOutput, err := c.decompress(r)
+		if err != nil {
+			return err
+		}
+		defer decompressorOutput.Close()
+		// Read one byte more than expected to detect oversized blobs, the hash check rejects them
+		_, err = io.Copy(io.MultiWriter(tmp, h), io.LimitReader(decompressorOutput, size+1))
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	if hex.EncodeToString(h.Sum(nil)) != hash {
+		return "", fmt.Errorf("Blob %s is corrupted", hash)
+	}
+	err = tmp.Chmod(mode)
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err != nil {
+		return "", err
+	}
+	tmp.Close()
+	err = os.Rename(tmp.Name(), local)
+	if err != nil {
+		return "", err
+	}
+	syncDir(localBlobsFolder)
+	return local, nil
+}
+
+// linkFile hard-links src to dst, or copies it if hard links aren't supported
+func linkFile(src, dst string) error {
+	if os.Link(src, dst) == nil {
+		return nil
+	}
+	fi, err := os.Stat(src)
+	if err != nil {
+		return err
+	}
+	return copyFile(src, dst, fi.Mode().Perm())
+}
+
+// copyFile copies src to the new file dst with mode
+func copyFile(src, dst string, mode os.FileMode) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	closeErr := w.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// versionBlobs returns the blobs referenced by the manifests of the blob version v
+// Their sizes are taken from assets, they are negative if assets weren't listed
+func versionBlobs(p types.Provider, v types.Version, assets []types.Asset) ([]types.Asset, error) {
+	c, err := versionCodec(v)
+	if err != nil {
+		return nil, err
+	}
+	manifests := []string{archiveName(v, "", c)}
+	if len(v.Platforms) > 0 {
+		manifests = nil
+		for _, a := range v.Platforms {
+			manifests = append(manifests, a.Asset)
+		}
+	}
+	sizes := make(map[string]int64)
+	for _, a := range assets {
+		sizes[a.Name] = a.Size
+	}
+	seen := make(map[string]bool)
+	var blobs []types.Asset
+	for _, name := range manifests {
+		m, err := readManifest(p, name)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range m.Files {
+			asset := blobAsset(f.Blob, c)
+			if seen[asset] {
+				continue
+			}
+			seen[asset] = true
+			size, ok := sizes[asset]
+			if !ok {
+				size = -1
+			}
+			blobs = append(blobs, types.Asset{Name: asset, Size: size, Time: v.Time})
+		}
+	}
+	return blobs, nil
+}
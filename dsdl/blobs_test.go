@@ -0,0 +1,205 @@
+package dsdl
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/davidmanzanares/dsd/provider/memory"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+func countBlobs(t *testing.T, p types.Provider) int {
+	stored, err := storedBlobs(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return len(stored)
+}
+
+func TestDeployBlobs(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	service := testService(t, "service")
+	target := Target{Name: "test", Service: service, Patterns: testPatterns, Blobs: true}
+	// Read-only files are hard-linked
+	err := os.Chmod("test-asset-basic-1", 0440)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := syncTestProvider(t, service)
+	blobs := countBlobs(t, p)
+	if !v1.Blobs || v1.Files != 7 || blobs != 7 {
+		t.Fatal(v1, blobs)
+	}
+	err = Download(service, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(v1, t)
+
+	// Only the changed file is uploaded again
+	err = ioutil.WriteFile("test-asset-basic-2", []byte("AssetB2"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countBlobs(t, p) != blobs+1 || v2.Size >= v1.Size {
+		t.Fatal(countBlobs(t, p), v1.Size, v2.Size)
+	}
+	exe, err := download(p, v2, Limits{})
+	if err != nil || exe != "assets/"+v2.Name+"/test-asset-basic-script" {
+		t.Fatal(exe, err)
+	}
+	b, err := ioutil.ReadFile("assets/" + v2.Name + "/test-asset-basic-2")
+	if err != nil || string(b) != "AssetB2" {
+		t.Fatal(string(b), err)
+	}
+	// The unchanged files are shared with the previous version
+	fi1, err := os.Stat("assets/" + v1.Name + "/test-asset-basic-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fi2, err := os.Stat("assets/" + v2.Name + "/test-asset-basic-1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !os.SameFile(fi1, fi2) {
+		t.Fatal("The unchanged file wasn't hard-linked")
+	}
+}
+
+func TestDeployBlobsDeletedByGC(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	service := testService(t, "service")
+	target := Target{Name: "test", Service: service, Patterns: testPatterns, Blobs: true}
+	_, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := syncTestProvider(t, service)
+	stored, err := storedBlobs(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// GC deletes a reused blob after the deploy listed it
+	hash, _ := hashFile("test-asset-basic-1")
+	c, _ := parseCompression("")
+	err = p.DeleteAsset(blobAsset(hash, c.codec))
+	if err != nil {
+		t.Fatal(err)
+	}
+	plan, err := DeployPlan(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = pushBlobs(p, "b"+manifestExtension, "", plan, c, stored, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if countBlobs(t, p) != 7 {
+		t.Fatal("The deleted blob wasn't uploaded again", countBlobs(t, p))
+	}
+}
+
+func TestDownloadBlobsModified(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	service := testService(t, "service")
+	target := Target{Name: "test", Service: service, Patterns: testPatterns, Blobs: true}
+	err := os.Chmod("test-asset-basic-1", 0440)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v1, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := syncTestProvider(t, service)
+	_, err = download(p, v1, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The files are hard-linked, they're modified through their hard links like their owner could
+	for _, name := range []string{"test-asset-basic-1", "test-asset-basic-2"} {
+		filename := "assets/" + v1.Name + "/" + name
+		err = os.Chmod(filename, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filename, []byte("Modified"), 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	err = ioutil.WriteFile("test-asset-basic-folder/test-asset-3", []byte("AssetC2"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = download(p, v2, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for name, content := range map[string]string{"test-asset-basic-1": "AssetA", "test-asset-basic-2": "AssetB"} {
+		b, err := ioutil.ReadFile("assets/" + v2.Name + "/" + name)
+		if err != nil || string(b) != content {
+			t.Fatal(name, string(b), err)
+		}
+	}
+	fi, err := os.Stat("assets/" + v2.Name + "/test-asset-basic-2")
+	if err != nil || fi.Mode().Perm()&0222 != 0 {
+		t.Fatal("The extracted files must be read-only", fi, err)
+	}
+}
+
+func TestDownloadBlobsInvalid(t *testing.T) {
+	defer deleteTestAssets()
+	p := memory.New()
+	c := codecs["none"]
+	hash := strings.Repeat("0", 64)
+	pushManifest := func(name string, files ...manifestFile) {
+		buff, _ := json.Marshal(manifest{Files: files})
+		p.PushAsset(name+manifestExtension, bytes.NewReader(buff))
+	}
+
+	p.PushAsset(blobAsset(hash, c), strings.NewReader("corrupted"))
+	pushManifest("corrupted", manifestFile{Name: "a", Mode: 0660, Size: 9, Blob: hash})
+	_, err := download(p, types.Version{Name: "corrupted", Codec: "none", Blobs: true}, Limits{})
+	if err == nil || !strings.Contains(err.Error(), "corrupted") {
+		t.Fatal("Expected corrupted blob error", err)
+	}
+
+	for i, f := range []manifestFile{
+		{Name: "../a", Mode: 0660, Blob: hash},
+		{Name: "a", Mode: 0660, Blob: "../" + hash},
+	} {
+		name := string(rune('a' + i))
+		pushManifest(name, f)
+		_, err = download(p, types.Version{Name: name, Codec: "none", Blobs: true}, Limits{})
+		if err == nil {
+			t.Fatal("Expected invalid manifest error", f)
+		}
+	}
+
+	pushManifest("limits", manifestFile{Name: "a", Mode: 0660, Size: 10, Blob: hash})
+	_, err = download(p, types.Version{Name: "limits", Codec: "none", Blobs: true}, Limits{MaxSize: 5})
+	if err == nil || !strings.Contains(err.Error(), "limit") {
+		t.Fatal("Expected limits error", err)
+	}
+}
@@ -0,0 +1,55 @@
+package dsdl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/davidmanzanares/dsd/provider"
+	"github.com/davidmanzanares/dsd/provider/bundle"
+)
+
+// BundleService returns the service reading the bundle filename, it can be used like any other service
+func BundleService(filename string) string {
+	return "bundle:" + filename
+}
+
+// Export writes a version of service and all its assets to the bundle filename
+// The current version is exported if version is empty
+func Export(service string, version string, filename string) (SyncResult, error) {
+	src, err := getProviderFromService(service)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	src = provider.WithRetry(src, provider.DefaultRetryPolicy)
+
+	// The bundle is written to a temporary file first, a failed export never leaves a truncated bundle
+	tmp, err := ioutil.TempFile(filepath.Dir(filename), ".tmp-"+filepath.Base(filename)+"-")
+	if err != nil {
+		return SyncResult{}, err
+	}
+	defer os.Remove(tmp.Name())
+	defer tmp.Close()
+
+	w := bundle.NewWriter(tmp)
+	result, err := syncProviders(src, w, SyncConf{Version: version, SetCurrent: true})
+	if err != nil {
+		return result, err
+	}
+	err = w.Close()
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if err == nil {
+		err = tmp.Close()
+	}
+	if err != nil {
+		return result, err
+	}
+	return result, os.Rename(tmp.Name(), filename)
+}
+
+// Import copies the version stored in the bundle filename to service, making it its current version
+func Import(filename string, service string) (SyncResult, error) {
+	return Sync(BundleService(filename), service, SyncConf{SetCurrent: true})
+}
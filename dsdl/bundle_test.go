@@ -0,0 +1,77 @@
+package dsdl
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+func TestExportImport(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	dir, err := ioutil.TempDir("", "dsd-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bundle.dsd")
+
+	service, imported := testService(t, "export"), testService(t, "import")
+	target := Target{Name: "test", Service: service, Patterns: testPatterns}
+	v1, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	result, err := Export(service, v1.Name, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Versions) != 1 || result.Versions[0].Name != v1.Name || result.Bytes == 0 {
+		t.Fatal(result)
+	}
+
+	// Bundles are downloaded like any other service
+	err = Download(BundleService(filename), Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(v1, t)
+
+	_, err = Import(filename, imported)
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := Versions(imported)
+	if err != nil || len(versions) != 1 || versions[0].Name != v1.Name || !versions[0].Time.Equal(v1.Time) {
+		t.Fatal(versions, err)
+	}
+}
+
+func TestExportErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsd-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	filename := filepath.Join(dir, "bundle.dsd")
+
+	_, err = Export("mem://export-empty", "", filename)
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected not found error", err)
+	}
+	if _, err := os.Stat(filename); !os.IsNotExist(err) {
+		t.Fatal("Failed exports can't leave a bundle", err)
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Fatal("Temporary files left", entries)
+	}
+}
@@ -0,0 +1,139 @@
+package dsdl
+
+import (
+	"compress/gzip"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+
+	"github.com/davidmanzanares/dsd/types"
+	"github.com/klauspost/compress/zstd"
+)
+
+// codec compresses the deployed tar archives
+type codec struct {
+	// name is recorded in the deployed versions
+	name string
+	// extension is the suffix of the archive assets, blobExtension the suffix of the blobs
+	extension     string
+	blobExtension string
+	// minLevel and maxLevel bound the levels of the codec, they are 0 if it doesn't have levels
+	minLevel, maxLevel int
+	// compress returns a writer compressing to w, level 0 is the codec default
+	compress   func(w io.Writer, level int) (io.WriteCloser, error)
+	decompress func(r io.Reader) (io.ReadCloser, error)
+}
+
+// defaultCodec is used by targets without codec, and by versions deployed before codecs were recorded
+const defaultCodec = "gzip"
+
+var codecs = map[string]codec{
+	"gzip": {
+		name: "gzip", extension: ".tar.gz", blobExtension: ".gz", minLevel: gzip.BestSpeed, maxLevel: gzip.BestCompression,
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				level = gzip.DefaultCompression
+			}
+			return gzip.NewWriterLevel(w, level)
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return gzip.NewReader(r)
+		},
+	},
+	"zstd": {
+		name: "zstd", extension: ".tar.zst", blobExtension: ".zst", minLevel: 1, maxLevel: 22,
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			if level == 0 {
+				return zstd.NewWriter(w)
+			}
+			return zstd.NewWriter(w, zstd.WithEncoderLevel(zstd.EncoderLevelFromZstd(level)))
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+			if err != nil {
+				return nil, err
+			}
+			return d.IOReadCloser(), nil
+		},
+	},
+	"none": {
+		name: "none", extension: ".tar",
+		compress: func(w io.Writer, level int) (io.WriteCloser, error) {
+			return nopWriteCloser{w}, nil
+		},
+		decompress: func(r io.Reader) (io.ReadCloser, error) {
+			return ioutil.NopCloser(r), nil
+		},
+	},
+}
+
+// compression is a codec along with its level
+type compression struct {
+	codec codec
+	level int
+}
+
+// parseCompression parses a target codec: "gzip", "zstd" or "none", optionally followed by ":<level>"
+// An empty spec is the default codec
+func parseCompression(spec string) (compression, error) {
+	if spec == "" {
+		spec = defaultCodec
+	}
+	name, level := spec, 0
+	if i := strings.Index(spec, ":"); i >= 0 {
+		name = spec[:i]
+		var err error
+		level, err = strconv.Atoi(spec[i+1:])
+		if err != nil {
+			return compression{}, fmt.Errorf("Invalid codec level %s: %w", spec, err)
+		}
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return compression{}, fmt.Errorf("Unknown codec %s, it must be gzip, zstd or none", name)
+	}
+	if strings.Contains(spec, ":") && (level < c.minLevel || level > c.maxLevel) {
+		if c.maxLevel == 0 {
+			return compression{}, fmt.Errorf("Codec %s doesn't have levels", name)
+		}
+		return compression{}, fmt.Errorf("Invalid codec level %s, it must be between %d and %d", spec, c.minLevel, c.maxLevel)
+	}
+	return compression{codec: c, level: level}, nil
+}
+
+// versionCodec returns the codec of the archives of v
+// It fails with types.ErrUnsupportedVersion if v was deployed with a codec unknown to this version of dsd
+func versionCodec(v types.Version) (codec, error) {
+	name := v.Codec
+	if name == "" {
+		name = defaultCodec
+	}
+	c, ok := codecs[name]
+	if !ok {
+		return codec{}, fmt.Errorf("Version %s uses the unknown codec %s: %w", v.Name, v.Codec, types.ErrUnsupportedVersion)
+	}
+	return c, nil
+}
+
+// archiveName returns the asset name of the archive of v compressed with c, platform is empty for single archive versions
+// The archives of blob versions are their manifests
+func archiveName(v types.Version, platform string, c codec) string {
+	extension := c.extension
+	if v.Blobs {
+		extension = manifestExtension
+	}
+	if platform == "" {
+		return v.Name + extension
+	}
+	return v.Name + "." + strings.Replace(platform, "/", "-", -1) + extension
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
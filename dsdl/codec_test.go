@@ -0,0 +1,74 @@
+package dsdl
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+
+	"github.com/davidmanzanares/dsd/provider/memory"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+func TestParseCompression(t *testing.T) {
+	for spec, expected := range map[string]compression{
+		"":        {codec: codecs["gzip"]},
+		"gzip:9":  {codec: codecs["gzip"], level: 9},
+		"zstd":    {codec: codecs["zstd"]},
+		"zstd:19": {codec: codecs["zstd"], level: 19},
+		"none":    {codec: codecs["none"]},
+	} {
+		c, err := parseCompression(spec)
+		if err != nil || c.codec.name != expected.codec.name || c.level != expected.level {
+			t.Fatal(spec, c, err)
+		}
+	}
+	for _, spec := range []string{"lz4", "gzip:0", "gzip:10", "zstd:x", "none:1"} {
+		_, err := parseCompression(spec)
+		if err == nil {
+			t.Fatal("Expected invalid codec error", spec)
+		}
+	}
+}
+
+func TestDeployCodecs(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	for _, spec := range []string{"gzip:1", "zstd", "zstd:3", "none"} {
+		service := "mem://deploy-codec-" + spec
+		v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns, Codec: spec}, DeployConf{})
+		if err != nil {
+			t.Fatal(spec, err)
+		}
+		c, _ := parseCompression(spec)
+		if v.Codec != c.codec.name {
+			t.Fatal(spec, v.Codec)
+		}
+		p, _ := memory.Create(service)
+		var archive bytes.Buffer
+		err = p.GetAsset(v.Name+c.codec.extension, &archive)
+		if err != nil || int64(archive.Len()) != v.Size {
+			t.Fatal(spec, archive.Len(), v.Size, err)
+		}
+		err = Download(service, Limits{})
+		if err != nil {
+			t.Fatal(spec, err)
+		}
+		checkFiles(v, t)
+	}
+}
+
+func TestDownloadCodecs(t *testing.T) {
+	defer deleteTestAssets()
+	p := memory.New()
+	// Versions deployed before codecs were recorded are gzipped
+	p.PushAsset("old.tar.gz", bytes.NewReader(testArchive(t, map[string]string{"a.sh": "#!/bin/sh"})))
+	exe, err := download(p, types.Version{Name: "old"}, Limits{})
+	if err != nil || exe != "assets/old/a.sh" {
+		t.Fatal(exe, err)
+	}
+
+	_, err = download(p, types.Version{Name: "new", Codec: "lz4"}, Limits{})
+	if !errors.Is(err, types.ErrUnsupportedVersion) {
+		t.Fatal("Expected unknown codec error", err)
+	}
+}
@@ -6,6 +6,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"strings"
+
+	"github.com/davidmanzanares/dsd/provider"
 )
 
 // Config is a set of targets
@@ -20,6 +22,32 @@ type Target struct {
 	Name     string `json:"-"`
 	Service  string
 	Patterns []string
+	// Entrypoint is the path of the program runners start, it must be one of the deployed executables
+	// The first executable matched by Patterns is used if it's empty
+	Entrypoint string `json:",omitempty"`
+	// Codec compresses the archives: "gzip", "zstd" or "none", optionally followed by ":<level>", like "gzip:9"
+	// gzip at its default level is used if it's empty
+	Codec string `json:",omitempty"`
+	// Blobs deploys every file as a content-addressed blob, only uploading the blobs missing from the service
+	// Runners only download the blobs they don't have yet, hard-linking them into the version folders
+	Blobs bool `json:",omitempty"`
+	// Platforms deploys an archive per platform, by "GOOS/GOARCH" or "GOOS" platform
+	// Runners download the archive of their platform
+	Platforms map[string]Platform `json:",omitempty"`
+	// Before hooks run before packaging, like build steps, a failure aborts the deploy
+	Before []Hook `json:",omitempty"`
+	// After hooks run after a successful deploy, with the version name in DSD_VERSION
+	After []Hook `json:",omitempty"`
+	// Retry configures the retries of the service's transient failures, provider.DefaultRetryPolicy is used if it's nil
+	Retry *provider.RetryPolicy `json:",omitempty"`
+}
+
+// Platform is the part of a target specific to a platform
+type Platform struct {
+	// Patterns are added to the target patterns
+	Patterns []string
+	// Entrypoint overrides the target entrypoint
+	Entrypoint string `json:",omitempty"`
 }
 
 // AddTarget loads the config from the default path, adds the new target, and saves the new config file
@@ -34,7 +62,7 @@ func (t Target) String() string {
 	for _, p := range t.Patterns {
 		patterns = append(patterns, `"`+p+`"`)
 	}
-	return fmt.Sprintf("\"%s\" (%s) {%s}", t.Name, t.Service, strings.Join(patterns, ", "))
+	return fmt.Sprintf("\"%s\" (%s) {%s}", t.Name, RedactService(t.Service), strings.Join(patterns, ", "))
 }
 
 // LoadConfig loads the config from the default path
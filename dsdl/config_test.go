@@ -4,6 +4,9 @@ import (
 	"os"
 	"reflect"
 	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/provider"
 )
 
 func TestConfig(t *testing.T) {
@@ -40,4 +43,18 @@ func TestConfig(t *testing.T) {
 	if !reflect.DeepEqual(conf, Config{Targets: expected}) {
 		t.Fatal(conf)
 	}
+
+	retrying := Target{Name: "retrying", Patterns: []string{"asd"}, Service: "myservice",
+		Retry: &provider.RetryPolicy{Attempts: 10, Timeout: time.Minute}}
+	err = AddTarget(retrying)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conf, err = LoadConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(conf.Targets["retrying"], &retrying) {
+		t.Fatal(conf.Targets["retrying"])
+	}
 }
@@ -2,140 +2,481 @@ package dsdl
 
 import (
 	"archive/tar"
-	"compress/gzip"
 	"encoding/hex"
 	"errors"
+	"fmt"
 	"io"
+	"io/ioutil"
 	"log"
 	"os"
 	"path"
 	"path/filepath"
+	"sort"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/davidmanzanares/dsd/internal/fileio"
+	"github.com/davidmanzanares/dsd/provider"
 	"github.com/davidmanzanares/dsd/types"
 )
 
+// DeployConf sets the metadata recorded in the deployed version, and the progress callback
+type DeployConf struct {
+	Message string
+	Meta    map[string]string
+	// Progress is called while packing and uploading from the goroutines writing the archives, and once more at the end
+	// from the Deploy goroutine
+	// Calls don't overlap and none is made after Deploy returns, state shared with other goroutines needs synchronization
+	Progress func(Progress)
+}
+
+// PlannedFile is a file which would be added to the archive
+type PlannedFile struct {
+	Name       string
+	Size       int64
+	Mode       os.FileMode
+	Executable bool
+}
+
+// Plan describes the archive Deploy would upload
+type Plan struct {
+	// Files are the matched files, in archive order
+	Files []PlannedFile
+	// UnmatchedPatterns are the patterns which didn't match any file
+	UnmatchedPatterns []string
+	// EstimatedSize is the compressed size of the archive, if the files don't change before deploying
+	// Blob targets only upload the blobs missing from their service, usually much less
+	EstimatedSize int64
+	// Entrypoint is the program runners would start
+	Entrypoint string
+	// Platforms has the plans of multi-platform targets, by platform
+	// The multi-platform plan only has the total EstimatedSize
+	Platforms map[string]Plan
+}
+
+// Executables returns the names of the executable files of the plan
+func (p Plan) Executables() []string {
+	var executables []string
+	for _, f := range p.Files {
+		if f.Executable {
+			executables = append(executables, f.Name)
+		}
+	}
+	return executables
+}
+
+// DeployPlan returns what Deploy would upload for target, without using its service
+// Hooks aren't run, the plan uses the files produced by the previous Before hooks
+func DeployPlan(target Target) (Plan, error) {
+	if len(target.Platforms) == 0 {
+		return planArchive(target)
+	}
+	platforms, err := targetPlatforms(target)
+	if err != nil {
+		return Plan{}, err
+	}
+	plan := Plan{Platforms: make(map[string]Plan)}
+	for _, platform := range platforms {
+		p, err := planArchive(platformTarget(target, platform))
+		if err != nil {
+			return plan, fmt.Errorf("Platform %s: %w", platform, err)
+		}
+		plan.Platforms[platform] = p
+		plan.EstimatedSize += p.EstimatedSize
+	}
+	return plan, nil
+}
+
+// planArchive returns the plan of the single archive of target
+func planArchive(target Target) (Plan, error) {
+	c, err := parseCompression(target.Codec)
+	if err != nil {
+		return Plan{}, err
+	}
+	plan, err := planFiles(target.Patterns)
+	if err != nil {
+		return Plan{}, err
+	}
+	plan.Entrypoint, err = resolveEntrypoint(plan, target)
+	if err != nil {
+		return plan, err
+	}
+	size := &fileio.CountingWriter{W: ioutil.Discard}
+	_, err = writeArchive(size, plan, c, nil)
+	if err != nil {
+		return Plan{}, err
+	}
+	plan.EstimatedSize = size.N
+	return plan, nil
+}
+
 // Deploy deploys the target patterned matches files to the target provider service
-func Deploy(target Target) (types.Version, error) {
+// Multi-platform targets deploy an archive per platform, every archive is planned before uploading any of them
+// Blob targets upload the files missing from the service as blobs, and a manifest instead of each archive
+// The deployer, the git checkout of the current folder and the archive stats are recorded in the version
+// The target's Before hooks run first, and its After hooks once the version is pushed,
+// the deployed version is returned along with the error if an After hook fails
+func Deploy(target Target, conf DeployConf) (types.Version, error) {
 	p, err := getProviderFromService(target.Service)
 	if err != nil {
 		return types.Version{}, err
 	}
-
-	/*gzipOutput, err := os.Create("out.tar.gzip")
+	var policy provider.RetryPolicy
+	if target.Retry != nil {
+		policy = *target.Retry
+	}
+	p = provider.WithRetry(p, policy)
+	c, err := parseCompression(target.Codec)
 	if err != nil {
-		return err
-	}*/
-
-	uid := hex.EncodeToString(uid())
-	providerInput, gzipOutput := io.Pipe()
-	gzipInput := gzip.NewWriter(gzipOutput)
-	tarInput := tar.NewWriter(gzipInput)
-	var pushError error
-	var barrier sync.WaitGroup
-	barrier.Add(1)
-	go func() {
-		pushError = p.PushAsset(uid+".tar.gz", providerInput)
-		barrier.Done()
-	}()
+		return types.Version{}, err
+	}
 
-	folders := make(map[string]bool)
+	// Hooks don't get the service credentials
+	env := []string{"DSD_TARGET=" + target.Name, "DSD_SERVICE=" + RedactService(target.Service)}
+	err = runHooks(target.Before, env)
+	if err != nil {
+		return types.Version{}, err
+	}
 
-	numExecutables := 0
-	for _, p := range target.Patterns {
-		matches, err := filepath.Glob(p)
+	type archive struct {
+		platform   string
+		target     Target
+		plan       Plan
+		entrypoint string
+	}
+	archives := []archive{{target: target}}
+	if len(target.Platforms) > 0 {
+		platforms, err := targetPlatforms(target)
+		if err != nil {
+			return types.Version{}, err
+		}
+		archives = nil
+		for _, platform := range platforms {
+			archives = append(archives, archive{platform: platform, target: platformTarget(target, platform)})
+		}
+	}
+	for i := range archives {
+		a := &archives[i]
+		prefix := ""
+		if a.platform != "" {
+			prefix = "Platform " + a.platform + ": "
+		}
+		a.plan, err = planFiles(a.target.Patterns)
 		if err != nil {
 			return types.Version{}, err
 		}
-		for _, filepath := range matches {
-			func() {
-				dir := path.Dir("./" + filepath)
+		for _, pattern := range a.plan.UnmatchedPatterns {
+			log.Println(prefix+"Pattern", pattern, "didn't match any file")
+		}
+		a.entrypoint, err = resolveEntrypoint(a.plan, a.target)
+		if err != nil {
+			return types.Version{}, fmt.Errorf("%s%w", prefix, err)
+		}
+		if executables := a.plan.Executables(); a.target.Entrypoint == "" && len(executables) > 1 {
+			log.Printf("%sSeveral executables deployed (%s), %s will be run, set the target entrypoint to choose it\n",
+				prefix, strings.Join(executables, ", "), a.entrypoint)
+		}
+	}
 
-				for i := 0; dir != "."; i++ {
-					if i == 1000 {
-						panic(i)
-					}
-					if !folders[dir] {
-						folders[dir] = true
-						fi, err := os.Stat(dir)
-						if err == nil {
-							hdr, err := tar.FileInfoHeader(fi, "")
-							if err != nil {
-								log.Println(err)
-							} else {
-								hdr.Name = dir
-								defer tarInput.WriteHeader(hdr)
-							}
-						} else {
-							log.Println(err)
-						}
-					}
-					dir = path.Dir(dir)
-				}
-			}()
-			f, err := os.Open(filepath)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			defer f.Close()
-			fi, err := f.Stat()
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			if fi.IsDir() {
-				continue
-			}
+	var plans []Plan
+	for _, a := range archives {
+		plans = append(plans, a.plan)
+	}
+	progress := newProgressReporter(conf.Progress, plans)
 
-			isExecutable := (fi.Mode()&0100) != 0 || strings.HasSuffix(filepath, ".exe")
-			if isExecutable {
-				numExecutables++
-			}
-			hdr, err := tar.FileInfoHeader(fi, "")
-			if err != nil {
-				log.Println(err)
-				continue
-			}
-			if strings.HasSuffix(filepath, ".exe") {
-				// Ensure .exe files are exeutable
-				hdr.Mode = hdr.Mode | 0100
-			}
-			hdr.Name = filepath
-			tarInput.WriteHeader(hdr)
-			_, err = io.Copy(tarInput, f)
-			if err != nil {
-				log.Println(err)
-				continue
-			}
+	v := deployMetadata(conf)
+	v.Name = hex.EncodeToString(uid())
+	v.Codec = c.codec.name
+	v.Blobs = target.Blobs
+	var stored map[string]bool
+	if v.Blobs {
+		stored, err = storedBlobs(p)
+		if err != nil {
+			return types.Version{}, err
 		}
 	}
-	if numExecutables == 0 {
-		return types.Version{}, errors.New("No executables")
+	for _, a := range archives {
+		asset := archiveName(v, a.platform, c.codec)
+		var size int64
+		var numFiles int
+		if v.Blobs {
+			size, numFiles, err = pushBlobs(p, asset, a.platform, a.plan, c, stored, progress)
+		} else {
+			size, numFiles, err = pushArchive(p, asset, a.platform, a.plan, c, progress)
+		}
+		if err != nil {
+			return types.Version{}, err
+		}
+		v.Size += size
+		v.Files += numFiles
+		var entrypoint string
+		if a.target.Entrypoint != "" {
+			entrypoint = a.entrypoint
+		}
+		if a.platform == "" {
+			v.Entrypoint = entrypoint
+			continue
+		}
+		if v.Platforms == nil {
+			v.Platforms = make(map[string]types.Artifact)
+		}
+		v.Platforms[a.platform] = types.Artifact{Asset: asset, Entrypoint: entrypoint, Size: size, Files: numFiles}
 	}
-	err = tarInput.Close()
+	v.Time = time.Now()
+	err = p.PushVersion(v)
 	if err != nil {
 		return types.Version{}, err
 	}
-	err = gzipInput.Close()
+	progress.done()
+	return v, runHooks(target.After, append(env, "DSD_VERSION="+v.Name))
+}
+
+// pushArchive writes the archive of plan to the asset name of p, it returns the archive size and its number of files
+func pushArchive(p types.Provider, name string, platform string, plan Plan, c compression, progress *progressReporter) (int64, int, error) {
+	archiveSize := &fileio.CountingWriter{}
+	progress.startArchive(platform, archiveSize)
+	saved := progress.save()
+	var numFiles int
+	err := pushAsset(p, name, func(w io.Writer) error {
+		// Retries write the archive again
+		progress.restore(saved)
+		archiveSize.N = 0
+		archiveSize.W = w
+		var err error
+		numFiles, err = writeArchive(archiveSize, plan, c, progress)
+		return err
+	})
 	if err != nil {
-		return types.Version{}, err
+		return 0, 0, err
+	}
+	return archiveSize.N, numFiles, nil
+}
+
+// pushAsset streams the content written by write to the asset name of p
+// write is run again every time p regenerates the content to retry the push, instead of spooling it
+func pushAsset(p types.Provider, name string, write func(w io.Writer) error) error {
+	source := &assetSource{write: write}
+	pushError := p.PushAsset(name, source.start())
+	// Unblock the writer if the provider stopped reading before the end
+	err := source.stop(pushError)
+	if err != nil && pushError == nil {
+		return err
+	}
+	return pushError
+}
+
+var errRegenerated = errors.New("Asset regenerated")
+
+// assetSource is the content of an asset produced by write, it's regenerated by running write again
+type assetSource struct {
+	write func(w io.Writer) error
+
+	mutex   sync.Mutex
+	current *assetStream
+}
+
+// assetStream reads a run of its source's write, it implements types.Regenerable
+type assetStream struct {
+	*io.PipeReader
+	source *assetSource
+	done   chan struct{}
+	err    error
+}
+
+// start stops the current run of write, starting a new one
+func (s *assetSource) start() *assetStream {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.current != nil {
+		s.current.stop(errRegenerated)
+	}
+	r, w := io.Pipe()
+	stream := &assetStream{PipeReader: r, source: s, done: make(chan struct{})}
+	go func() {
+		stream.err = s.write(w)
+		// The push fails too if the asset couldn't be written
+		w.CloseWithError(stream.err)
+		close(stream.done)
+	}()
+	s.current = stream
+	return stream
+}
+
+// stop stops the current run of write, returning its error
+func (s *assetSource) stop(err error) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.current.stop(err)
+}
+
+// stop closes the pipe with err, waiting for the end of write
+func (s *assetStream) stop(err error) error {
+	s.CloseWithError(err)
+	<-s.done
+	return s.err
+}
+
+func (s *assetStream) Regenerate() (io.Reader, error) {
+	return s.source.start(), nil
+}
+
+// targetPlatforms returns the sorted platforms of target, checking their names
+func targetPlatforms(target Target) ([]string, error) {
+	var platforms []string
+	for platform := range target.Platforms {
+		parts := strings.Split(platform, "/")
+		valid := len(parts) <= 2
+		for _, part := range parts {
+			valid = valid && part != "" && strings.Trim(part, "abcdefghijklmnopqrstuvwxyz0123456789") == ""
+		}
+		if !valid {
+			return nil, fmt.Errorf("Invalid platform %s, it must be GOOS/GOARCH or GOOS, like linux/amd64", platform)
+		}
+		platforms = append(platforms, platform)
+	}
+	sort.Strings(platforms)
+	return platforms, nil
+}
+
+// platformTarget returns the single archive target of platform
+func platformTarget(target Target, platform string) Target {
+	p := target.Platforms[platform]
+	t := target
+	t.Platforms = nil
+	t.Patterns = append(append([]string(nil), target.Patterns...), p.Patterns...)
+	if p.Entrypoint != "" {
+		t.Entrypoint = p.Entrypoint
+	}
+	return t
+}
+
+// resolveEntrypoint returns the slash separated path of the program runners would start
+// It fails if the target entrypoint isn't an executable of plan or if there aren't executables
+func resolveEntrypoint(plan Plan, target Target) (string, error) {
+	executables := plan.Executables()
+	if target.Entrypoint == "" {
+		if len(executables) == 0 {
+			return "", fmt.Errorf("No executables in %s: %w", strings.Join(target.Patterns, ", "), types.ErrNoExecutable)
+		}
+		return filepath.ToSlash(executables[0]), nil
 	}
-	gzipOutput.Close()
+	entrypoint := filepath.ToSlash(filepath.Clean(target.Entrypoint))
+	for _, f := range plan.Files {
+		if filepath.ToSlash(filepath.Clean(f.Name)) != entrypoint {
+			continue
+		}
+		if !f.Executable {
+			return "", fmt.Errorf("Entrypoint %s isn't executable: %w", target.Entrypoint, types.ErrNoExecutable)
+		}
+		return entrypoint, nil
+	}
+	return "", fmt.Errorf("Entrypoint %s isn't matched by %s: %w", target.Entrypoint, strings.Join(target.Patterns, ", "), types.ErrNoExecutable)
+}
+
+// planFiles resolves patterns into the list of files to deploy, see matchPatterns
+// Matched folders are skipped, files matched by many patterns are only listed once
+func planFiles(patterns []string) (Plan, error) {
+	matches, unmatched, err := matchPatterns(patterns)
 	if err != nil {
-		return types.Version{}, err
+		return Plan{}, err
 	}
-	barrier.Wait()
-	if pushError != nil {
-		return types.Version{}, pushError
+	plan := Plan{UnmatchedPatterns: unmatched}
+	seen := make(map[string]bool)
+	for _, filepath := range matches {
+		if seen[filepath] {
+			continue
+		}
+		seen[filepath] = true
+		fi, err := os.Stat(filepath)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		if fi.IsDir() {
+			continue
+		}
+		isExecutable := (fi.Mode()&0100) != 0 || strings.HasSuffix(filepath, ".exe")
+		plan.Files = append(plan.Files, PlannedFile{Name: filepath, Size: fi.Size(), Mode: fi.Mode(), Executable: isExecutable})
 	}
+	return plan, nil
+}
 
-	v := types.Version{Name: uid, Time: time.Now()}
-	err = p.PushVersion(v)
+// writeArchive writes the files of plan to w as a tar compressed with c, along with their parent folders
+// Files which can't be read are skipped, it returns the number of written files
+func writeArchive(w io.Writer, plan Plan, c compression, progress *progressReporter) (int, error) {
+	compressorInput, err := c.codec.compress(w, c.level)
 	if err != nil {
-		return types.Version{}, err
+		return 0, err
+	}
+	tarInput := tar.NewWriter(compressorInput)
+	folders := make(map[string]bool)
+	numFiles := 0
+	for _, planned := range plan.Files {
+		filepath := planned.Name
+		func() {
+			dir := path.Dir("./" + filepath)
+
+			for i := 0; dir != "."; i++ {
+				if i == 1000 {
+					panic(i)
+				}
+				if !folders[dir] {
+					folders[dir] = true
+					fi, err := os.Stat(dir)
+					if err == nil {
+						hdr, err := tar.FileInfoHeader(fi, "")
+						if err != nil {
+							log.Println(err)
+						} else {
+							hdr.Name = dir
+							defer tarInput.WriteHeader(hdr)
+						}
+					} else {
+						log.Println(err)
+					}
+				}
+				dir = path.Dir(dir)
+			}
+		}()
+		f, err := os.Open(filepath)
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		fi, err := f.Stat()
+		if err != nil {
+			f.Close()
+			log.Println(err)
+			continue
+		}
+		hdr, err := tar.FileInfoHeader(fi, "")
+		if err != nil {
+			f.Close()
+			log.Println(err)
+			continue
+		}
+		if strings.HasSuffix(filepath, ".exe") {
+			// Ensure .exe files are exeutable
+			hdr.Mode = hdr.Mode | 0100
+		}
+		hdr.Name = filepath
+		err = tarInput.WriteHeader(hdr)
+		if err != nil {
+			f.Close()
+			return numFiles, err
+		}
+		numFiles++
+		_, err = io.Copy(tarInput, progressReader{r: f, reporter: progress})
+		f.Close()
+		if err != nil {
+			return numFiles, err
+		}
+		progress.fileDone()
+	}
+	err = tarInput.Close()
+	if err != nil {
+		return numFiles, err
 	}
-	return v, nil
+	return numFiles, compressorInput.Close()
 }
@@ -1,19 +1,211 @@
 package dsdl
 
-import "testing"
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/provider"
+	"github.com/davidmanzanares/dsd/provider/memory"
+	"github.com/davidmanzanares/dsd/types"
+)
 
 func TestDeployFailureNoExecutable(t *testing.T) {
-	service := "s3://dsd-s3-test/tests"
-	_, err := Deploy(Target{Name: "test", Service: service, Patterns: []string{"test-asset-1"}})
-	if err == nil {
-		t.Fatal("Deploy should fail when there is no executable")
+	service := "mem://tests"
+	_, err := Deploy(Target{Name: "test", Service: service, Patterns: []string{"test-asset-1"}}, DeployConf{})
+	if !errors.Is(err, types.ErrNoExecutable) {
+		t.Fatal("Deploy should fail when there is no executable", err)
 	}
 }
 
 func TestDeployServiceFailure(t *testing.T) {
-	service := "s3://dsd-s3-test-invalid/tests"
-	_, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns})
+	service := "invalid://tests"
+	_, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
+	if !errors.Is(err, types.ErrUnknownScheme) {
+		t.Fatal("Deploy should fail when the service URL is invalid", err)
+	}
+}
+
+func TestDeployMetadata(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	service := testService(t, "service")
+	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{Message: "Fix", Meta: map[string]string{"ticket": "123"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The tests run in this repository's checkout
+	if v.Message != "Fix" || v.Meta["ticket"] != "123" || v.Files != 7 || v.Size == 0 || v.Hostname == "" || v.Git == nil {
+		t.Fatal(v, v.Message, v.Meta, v.Files, v.Size, v.Hostname, v.Git)
+	}
+	versions, err := Versions(service)
+	if err != nil || len(versions) != 1 || versions[0].Message != "Fix" || versions[0].Files != v.Files {
+		t.Fatal(versions, err)
+	}
+}
+
+func TestDeployPlan(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	target := Target{Name: "test", Service: "invalid://tests", Patterns: append([]string{"test-asset-basic-1", "missing-*"}, testPatterns...)}
+	plan, err := DeployPlan(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Files) != 7 || plan.Files[0].Name != "test-asset-basic-1" || plan.Files[0].Size != 6 {
+		t.Fatal(plan.Files)
+	}
+	if len(plan.UnmatchedPatterns) != 1 || plan.UnmatchedPatterns[0] != "missing-*" {
+		t.Fatal(plan.UnmatchedPatterns)
+	}
+	executables := plan.Executables()
+	if len(executables) != 3 || executables[0] != "test-asset-basic-script" {
+		t.Fatal(executables)
+	}
+
+	// The estimation is exact while the files don't change
+	target.Service = "mem://deploy-plan"
+	v, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if plan.EstimatedSize != v.Size {
+		t.Fatal(plan.EstimatedSize, "!=", v.Size)
+	}
+}
+
+func TestDeployEntrypoint(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	target := Target{Name: "test", Service: "mem://deploy-entrypoint", Patterns: testPatterns}
+	plan, err := DeployPlan(target)
+	if err != nil || plan.Entrypoint != "test-asset-basic-script" {
+		t.Fatal(plan.Entrypoint, err)
+	}
+	v, err := Deploy(target, DeployConf{})
+	if err != nil || v.Entrypoint != "" {
+		t.Fatal(v.Entrypoint, err)
+	}
+
+	target.Entrypoint = "./test-asset-failure-script"
+	v, err = Deploy(target, DeployConf{})
+	if err != nil || v.Entrypoint != "test-asset-failure-script" {
+		t.Fatal(v.Entrypoint, err)
+	}
+	exe, err := download(syncTestProvider(t, target.Service), v, Limits{})
+	if err != nil || exe != "assets/"+v.Name+"/test-asset-failure-script" {
+		t.Fatal(exe, err)
+	}
+
+	for _, entrypoint := range []string{"test-asset-basic-1", "missing", "test-asset-basic-folder"} {
+		target.Entrypoint = entrypoint
+		_, err = Deploy(target, DeployConf{})
+		if !errors.Is(err, types.ErrNoExecutable) {
+			t.Fatal("Expected invalid entrypoint error", entrypoint, err)
+		}
+		_, err = DeployPlan(target)
+		if !errors.Is(err, types.ErrNoExecutable) {
+			t.Fatal("Expected invalid entrypoint error", entrypoint, err)
+		}
+	}
+}
+
+func TestDeployPlatforms(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	host := runtime.GOOS + "/" + runtime.GOARCH
+	target := Target{Name: "test", Service: "mem://deploy-platforms", Patterns: []string{"test-asset-basic-1"},
+		Platforms: map[string]Platform{
+			host:    {Patterns: []string{"test-asset-basic-script"}},
+			"plan9": {Patterns: []string{"test-asset-failure-script", "test-asset-sleep-script"}, Entrypoint: "test-asset-sleep-script"},
+		}}
+	plan, err := DeployPlan(target)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan.Platforms) != 2 || len(plan.Platforms[host].Files) != 2 || plan.Platforms["plan9"].Entrypoint != "test-asset-sleep-script" ||
+		plan.EstimatedSize != plan.Platforms[host].EstimatedSize+plan.Platforms["plan9"].EstimatedSize {
+		t.Fatal(plan)
+	}
+
+	v, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostArchive := v.Platforms[host]
+	if len(v.Platforms) != 2 || hostArchive.Asset != v.Name+"."+runtime.GOOS+"-"+runtime.GOARCH+".tar.gz" || hostArchive.Files != 2 ||
+		v.Platforms["plan9"].Entrypoint != "test-asset-sleep-script" || v.Files != 5 {
+		t.Fatal(v.Platforms, v.Files)
+	}
+	p := syncTestProvider(t, target.Service)
+	exe, err := download(p, v, Limits{})
+	if err != nil || exe != "assets/"+v.Name+"/test-asset-basic-script" {
+		t.Fatal(exe, err)
+	}
+
+	// Runners fail clearly without an archive for their platform
+	delete(v.Platforms, host)
+	v.Name = "other-platforms"
+	_, err = download(p, v, Limits{})
+	if !errors.Is(err, types.ErrUnsupportedVersion) || !strings.Contains(err.Error(), "only for plan9") {
+		t.Fatal("Expected missing platform error", err)
+	}
+
+	target.Platforms["linux/"] = Platform{}
+	_, err = Deploy(target, DeployConf{})
 	if err == nil {
-		t.Fatal("Deploy should fail when the service URL is invalid")
+		t.Fatal("Expected invalid platform error")
+	}
+}
+
+// interruptedProvider fails the first push after reading half of the asset
+type interruptedProvider struct {
+	*memory.Memory
+	interrupted bool
+}
+
+func (p *interruptedProvider) PushAsset(name string, reader io.Reader) error {
+	if !p.interrupted {
+		p.interrupted = true
+		io.CopyN(ioutil.Discard, reader, 100)
+		return types.WrapError(types.ErrTransient, errors.New("Connection lost"))
+	}
+	return p.Memory.PushAsset(name, reader)
+}
+
+func TestDeployRetryRegenerates(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	plan, err := DeployPlan(Target{Name: "test", Patterns: testPatterns})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c, _ := parseCompression("")
+	// The archive is written again instead of spooled, spooling fails
+	flaky := &interruptedProvider{Memory: memory.New()}
+	p := provider.WithRetry(flaky, provider.RetryPolicy{Backoff: time.Millisecond, SpoolDir: "/nonexistent/dsd-spool"})
+	var last Progress
+	progress := newProgressReporter(func(p Progress) { last = p }, []Plan{plan})
+	size, numFiles, err := pushArchive(p, "a.tar.gz", "", plan, c, progress)
+	if err != nil || !flaky.interrupted {
+		t.Fatal(err, flaky.interrupted)
+	}
+	progress.done()
+	var archive bytes.Buffer
+	err = flaky.Memory.GetAsset("a.tar.gz", &archive)
+	if err != nil || int64(archive.Len()) != size || numFiles != len(plan.Files) {
+		t.Fatal(archive.Len(), size, numFiles, err)
+	}
+	if last.Files != numFiles || last.Bytes != last.TotalBytes || last.Uploaded != size {
+		t.Fatal("The progress of the interrupted push must not be counted", last, size)
+	}
+	exe, err := download(flaky.Memory, types.Version{Name: "a", Entrypoint: plan.Entrypoint}, Limits{})
+	if err != nil || exe == "" {
+		t.Fatal(exe, err)
 	}
 }
@@ -2,84 +2,503 @@ package dsdl
 
 import (
 	"archive/tar"
-	"compress/gzip"
+	"errors"
+	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 
+	"github.com/davidmanzanares/dsd/provider"
 	"github.com/davidmanzanares/dsd/types"
 )
 
+// assetsFolder is the local folder where versions are downloaded
+const assetsFolder = "assets"
+
+// partialPrefix prefixes the staging folders of the downloads in progress
+const partialPrefix = ".partial-"
+
+// partialStaleAge is the time after which a staging folder without changes belongs to an interrupted download
+const partialStaleAge = time.Hour
+
+// completeSuffix is appended to a version folder name to form its completion marker path
+const completeSuffix = ".complete"
+
+// Limits bounds the resources used by the extraction of a downloaded archive
+type Limits struct {
+	// MaxSize is the maximum total uncompressed size in bytes
+	MaxSize int64
+	// MaxFiles is the maximum number of archive entries
+	MaxFiles int
+}
+
+// DefaultLimits are used for every zero field of the Limits passed to Download or set in RunConf
+// Negative values disable a limit
+var DefaultLimits = Limits{MaxSize: 16 << 30, MaxFiles: 1000000}
+
+func (l Limits) withDefaults() Limits {
+	if l.MaxSize == 0 {
+		l.MaxSize = DefaultLimits.MaxSize
+	}
+	if l.MaxFiles == 0 {
+		l.MaxFiles = DefaultLimits.MaxFiles
+	}
+	return l
+}
+
 // Download the assets deployed on service
-func Download(service string) error {
+func Download(service string, limits Limits) error {
 	p, err := getProviderFromService(service)
 	if err != nil {
 		return err
 	}
+	p = provider.WithRetry(p, provider.DefaultRetryPolicy)
 
 	v, err := p.GetCurrentVersion()
 	if err != nil {
 		return err
 	}
-	_, err = download(p, v)
+	cleanPartialDownloads()
+	_, err = download(p, v, limits.withDefaults())
 	return err
 }
 
-func download(p types.Provider, v types.Version) (string, error) {
-	gzipInput, s3Output := io.Pipe()
+// download downloads v into assets/<version>/ and returns the path of its entrypoint, or of its first executable
+// if it doesn't have an entrypoint, the path is empty if there isn't any executable to run
+// It fails with types.ErrNoExecutable if the entrypoint of v isn't an executable file,
+// and with types.ErrUnsupportedVersion if v can't be run by this version of dsd
+// The archive is extracted into a staging folder which is only moved into place after a full success,
+// a completion marker is written afterwards, completed versions aren't downloaded again
+func download(p types.Provider, v types.Version, limits Limits) (string, error) {
+	folder := filepath.Join(assetsFolder, v.Name)
+	marker := folder + completeSuffix
+	if exe, ok := completed(folder); ok {
+		return exe, nil
+	}
+
+	err := os.MkdirAll(assetsFolder, 0770)
+	if err != nil {
+		return "", err
+	}
+	staging, err := ioutil.TempDir(assetsFolder, partialPrefix+v.Name+"-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(staging)
+
+	c, err := versionCodec(v)
+	if err != nil {
+		return "", err
+	}
+	asset, entrypoint, err := platformArtifact(v, c)
+	if err != nil {
+		return "", err
+	}
+	var executables []string
+	if v.Blobs {
+		executables, err = extractBlobs(p, asset, c, staging, limits)
+	} else {
+		executables, err = extract(p, asset, c, staging, limits)
+	}
+	if err != nil {
+		return "", err
+	}
+	var executable string
+	if len(executables) > 0 {
+		executable = executables[0]
+	}
+	if entrypoint != "" {
+		executable, err = checkEntrypoint(staging, entrypoint, executables)
+		if err != nil {
+			// Not marked as complete, a fixed deploy with the same name would be downloaded again
+			return "", fmt.Errorf("Version %s can't be run: %s: %w", v.Name, err, types.ErrNoExecutable)
+		}
+	}
+
+	// Other runners sharing the assets folder may have downloaded the version meanwhile
+	if exe, ok := completed(folder); ok {
+		return exe, nil
+	}
+	// Leftovers of a previous download interrupted before writing its marker are moved aside, not removed in place,
+	// the folder is never left half-deleted for a concurrent download
+	aside := staging + "-old"
+	err = os.Rename(folder, aside)
+	if err != nil && !os.IsNotExist(err) {
+		return "", err
+	}
+	defer os.RemoveAll(aside)
+	err = os.Rename(staging, folder)
+	if err != nil {
+		// A concurrent download of the same version won the swap, its files are the same
+		if _, statErr := os.Stat(folder); statErr != nil {
+			return "", err
+		}
+	}
+	syncDir(assetsFolder)
+
+	var exe string
+	if executable != "" {
+		exe = path.Join(assetsFolder, v.Name, executable)
+	}
+	err = writeFileSync(marker+".tmp", []byte(exe), 0660)
+	if err != nil {
+		return "", err
+	}
+	err = os.Rename(marker+".tmp", marker)
+	if err != nil {
+		return "", err
+	}
+	syncDir(assetsFolder)
+	return exe, nil
+}
+
+// completed returns the entrypoint recorded by the completion marker of the version folder, if it's complete
+func completed(folder string) (string, bool) {
+	exe, err := ioutil.ReadFile(folder + completeSuffix)
+	if err != nil {
+		return "", false
+	}
+	if _, err := os.Stat(folder); err != nil {
+		return "", false
+	}
+	return string(exe), true
+}
+
+var errExtractionAborted = errors.New("extraction aborted")
+
+// platformArtifact returns the archive of v compressed with c and the entrypoint for the running platform
+// It fails with types.ErrUnsupportedVersion if v is a multi-platform version without an archive for it
+func platformArtifact(v types.Version, c codec) (string, string, error) {
+	if len(v.Platforms) == 0 {
+		return archiveName(v, "", c), v.Entrypoint, nil
+	}
+	for _, platform := range []string{runtime.GOOS + "/" + runtime.GOARCH, runtime.GOOS} {
+		if a, ok := v.Platforms[platform]; ok {
+			return a.Asset, a.Entrypoint, nil
+		}
+	}
+	var available []string
+	for platform := range v.Platforms {
+		available = append(available, platform)
+	}
+	sort.Strings(available)
+	return "", "", fmt.Errorf("Version %s has no archive for %s/%s, only for %s: %w",
+		v.Name, runtime.GOOS, runtime.GOARCH, strings.Join(available, ", "), types.ErrUnsupportedVersion)
+}
+
+// extract writes the archive asset, compressed with c, into folder, every file is synced to disk before returning
+// It returns the names of the files recorded as executables in the archive, in archive order
+func extract(p types.Provider, asset string, c codec, folder string, limits Limits) ([]string, error) {
+	var executables []string
+	err := readAsset(p, asset, func(r io.Reader) error {
+		var err error
+		executables, err = untar(r, c, folder, limits)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	syncDir(folder)
+	return executables, nil
+}
+
+// readAsset streams the asset name of p to read
+func readAsset(p types.Provider, name string, read func(r io.Reader) error) error {
+	assetInput, providerOutput := io.Pipe()
 	var barrier sync.WaitGroup
 	barrier.Add(1)
-	var err2 error
+	var providerErr error
 	go func() {
-		err2 = p.GetAsset(v.Name+".tar.gz", s3Output)
-		s3Output.Close()
+		providerErr = p.GetAsset(name, providerOutput)
+		providerOutput.CloseWithError(providerErr)
 		barrier.Done()
 	}()
 
-	gzipOutput, err := gzip.NewReader(gzipInput)
-	if err != nil {
-		return "", err
+	err := read(assetInput)
+	// Unblock the provider if the reader failed before reading the whole asset
+	assetInput.CloseWithError(errExtractionAborted)
+	barrier.Wait()
+	if providerErr != nil && !errors.Is(providerErr, errExtractionAborted) {
+		return providerErr
 	}
+	return err
+}
 
-	tarReader := tar.NewReader(gzipOutput)
-
-	folder := "assets/" + v.Name + "/"
-	err = os.MkdirAll(folder, 0770)
+func untar(r io.Reader, c codec, folder string, limits Limits) ([]string, error) {
+	decompressorOutput, err := c.decompress(r)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	var executableFilepath string
+	defer decompressorOutput.Close()
+	tarReader := tar.NewReader(decompressorOutput)
+
+	var executables []string
+	// symlinks has the names of the extracted symlinks
+	symlinks := make(map[string]bool)
+	var size int64
+	var files int
 	for {
 		h, err := tarReader.Next()
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return "", err
+			return nil, err
+		}
+		files++
+		if limits.MaxFiles > 0 && files > limits.MaxFiles {
+			return nil, fmt.Errorf("Archive exceeds the limit of %d files", limits.MaxFiles)
+		}
+		size += h.Size
+		if limits.MaxSize > 0 && size > limits.MaxSize {
+			return nil, fmt.Errorf("Archive exceeds the limit of %d uncompressed bytes", limits.MaxSize)
+		}
+
+		name, err := sanitizeName(h.Name)
+		if err != nil {
+			return nil, err
 		}
-		filepath := folder + h.Name
+		if name == "." {
+			continue
+		}
+		err = checkNoSymlinks(folder, name)
+		if err != nil {
+			return nil, err
+		}
+		filename := filepath.Join(folder, filepath.FromSlash(name))
+		// Never write through an existing symlink
+		if fi, err := os.Lstat(filename); err == nil && !fi.IsDir() {
+			err = os.Remove(filename)
+			if err != nil {
+				return nil, err
+			}
+			delete(symlinks, name)
+		}
+		// Setuid, setgid and sticky bits are never restored
+		mode := os.FileMode(h.Mode).Perm()
 
-		if h.FileInfo().IsDir() {
-			os.Mkdir(filepath, h.FileInfo().Mode().Perm())
+		switch h.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(filename, mode|0700)
+			if err != nil {
+				return nil, err
+			}
+			continue
+		case tar.TypeReg:
+		case tar.TypeSymlink:
+			// Symlinks must point inside folder too
+			linkname := strings.Replace(h.Linkname, `\`, "/", -1)
+			_, err := sanitizeName(path.Join(path.Dir(name), linkname))
+			if err != nil || path.IsAbs(linkname) || throughSymlink(name, linkname, symlinks) {
+				return nil, fmt.Errorf("Invalid archive symlink: %s -> %s", h.Name, h.Linkname)
+			}
+			err = os.MkdirAll(filepath.Dir(filename), 0770)
+			if err != nil {
+				return nil, err
+			}
+			err = os.Symlink(filepath.FromSlash(linkname), filename)
+			if err != nil {
+				return nil, err
+			}
+			symlinks[name] = true
+			continue
+		case tar.TypeLink:
+			target, err := sanitizeName(h.Linkname)
+			if err != nil {
+				return nil, err
+			}
+			err = checkNoSymlinks(folder, target)
+			if err != nil {
+				return nil, err
+			}
+			// Hard links to symlinks would copy their target, relative to another folder
+			source := filepath.Join(folder, filepath.FromSlash(target))
+			if fi, err := os.Lstat(source); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+				return nil, fmt.Errorf("Invalid archive hard link to a symlink: %s -> %s", h.Name, h.Linkname)
+			}
+			err = os.MkdirAll(filepath.Dir(filename), 0770)
+			if err != nil {
+				return nil, err
+			}
+			err = os.Link(source, filename)
+			if err != nil {
+				return nil, err
+			}
+			// Hard links share the mode of their target
+			for _, e := range executables {
+				if e == target {
+					executables = append(executables, name)
+					break
+				}
+			}
 			continue
+		default:
+			return nil, fmt.Errorf("Unsupported archive entry type (%c): %s", h.Typeflag, h.Name)
 		}
 
-		if h.Mode&0100 != 0 && executableFilepath == "" {
-			executableFilepath = filepath
+		if mode&0100 != 0 {
+			executables = append(executables, name)
 		}
 
-		f, err := os.OpenFile(filepath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, os.FileMode(h.Mode))
+		err = os.MkdirAll(filepath.Dir(filename), 0770)
 		if err != nil {
-			log.Println(err)
-			continue
+			return nil, err
+		}
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+		if err != nil {
+			return nil, err
+		}
+		_, err = io.Copy(f, tarReader)
+		if err == nil {
+			err = f.Sync()
+		}
+		closeErr := f.Close()
+		if err != nil {
+			return nil, err
+		}
+		if closeErr != nil {
+			return nil, closeErr
 		}
-		defer f.Close()
-		io.Copy(f, tarReader)
 	}
-	barrier.Wait()
-	if err2 != nil {
+	// Read the compression footer, verifying the archive checksum
+	_, err = io.Copy(ioutil.Discard, decompressorOutput)
+	if err != nil {
+		return nil, err
+	}
+	return executables, decompressorOutput.Close()
+}
+
+// checkEntrypoint returns the sanitized entrypoint if it's a file inside folder recorded in executables
+// The recorded modes are checked, the extracted files don't have executable bits on Windows,
+// where .exe files are executable too
+func checkEntrypoint(folder, entrypoint string, executables []string) (string, error) {
+	name, err := sanitizeName(entrypoint)
+	if err != nil {
 		return "", err
 	}
-	return executableFilepath, nil
+	fi, err := os.Lstat(filepath.Join(folder, filepath.FromSlash(name)))
+	if err != nil {
+		return "", fmt.Errorf("Entrypoint %s not found in the archive", entrypoint)
+	}
+	executable := runtime.GOOS == "windows" && strings.EqualFold(path.Ext(name), ".exe")
+	for _, e := range executables {
+		executable = executable || e == name
+	}
+	if !fi.Mode().IsRegular() || !executable {
+		return "", fmt.Errorf("Entrypoint %s isn't an executable file", entrypoint)
+	}
+	return name, nil
+}
+
+// throughSymlink returns true if the target linkname of the symlink name passes through any of symlinks
+// The extracted symlinks are resolved by the OS, the target could point outside the extraction folder through them
+func throughSymlink(name, linkname string, symlinks map[string]bool) bool {
+	current := path.Dir(name)
+	for _, part := range strings.Split(linkname, "/") {
+		switch part {
+		case "", ".":
+		case "..":
+			current = path.Dir(current)
+		default:
+			current = path.Join(current, part)
+			if symlinks[current] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// sanitizeName normalises an archive entry name into a slash separated path relative to the extraction folder
+// Names which would be placed outside the extraction folder are rejected
+func sanitizeName(name string) (string, error) {
+	clean := path.Clean(strings.Replace(name, `\`, "/", -1))
+	if path.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") ||
+		(len(clean) >= 2 && clean[1] == ':') {
+		return "", fmt.Errorf("Invalid archive entry name: %s", name)
+	}
+	return clean, nil
+}
+
+// checkNoSymlinks returns an error if any parent folder of name, inside folder, is a symlink
+// This prevents writing outside folder through previously extracted symlinks
+func checkNoSymlinks(folder, name string) error {
+	dir := path.Dir(name)
+	var parents []string
+	for ; dir != "."; dir = path.Dir(dir) {
+		parents = append(parents, dir)
+	}
+	for i := len(parents) - 1; i >= 0; i-- {
+		fi, err := os.Lstat(filepath.Join(folder, filepath.FromSlash(parents[i])))
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Invalid archive entry, its path contains a symlink: %s", name)
+		}
+	}
+	return nil
+}
+
+// cleanPartialDownloads removes the staging folders left by interrupted downloads
+// Staging folders changed during the last partialStaleAge are kept, other runners may be downloading into them
+func cleanPartialDownloads() {
+	entries, err := ioutil.ReadDir(assetsFolder)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		folder := filepath.Join(assetsFolder, e.Name())
+		if e.IsDir() && strings.HasPrefix(e.Name(), partialPrefix) && time.Since(lastModified(folder)) > partialStaleAge {
+			os.RemoveAll(folder)
+		}
+	}
+}
+
+// lastModified returns the most recent modification time of folder and of the files inside it
+func lastModified(folder string) time.Time {
+	var last time.Time
+	filepath.Walk(folder, func(path string, fi os.FileInfo, err error) error {
+		if err == nil && fi.ModTime().After(last) {
+			last = fi.ModTime()
+		}
+		return nil
+	})
+	return last
+}
+
+func writeFileSync(filename string, data []byte, perm os.FileMode) error {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// syncDir flushes the folder entries to disk, not every platform supports it so errors are ignored
+func syncDir(folder string) {
+	d, err := os.Open(folder)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
 }
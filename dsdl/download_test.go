@@ -1,19 +1,347 @@
 package dsdl
 
-import "testing"
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/provider/memory"
+	"github.com/davidmanzanares/dsd/types"
+)
 
 func TestDeployDownload(t *testing.T) {
 	createTestAssets()
 	defer deleteTestAssets()
 
-	service := "s3://dsd-s3-test/tests"
-	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns})
+	service := "mem://tests"
+	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	err = Download("s3://dsd-s3-test/tests")
+	err = Download(service, Limits{})
 	if err != nil {
 		t.Fatal(err)
 	}
 	checkFiles(v, t)
 }
+
+// failingProvider makes GetAsset fail after writing failAfter bytes
+type failingProvider struct {
+	*memory.Memory
+	failAfter int
+}
+
+func (p *failingProvider) GetAsset(name string, writer io.Writer) error {
+	if p.failAfter == 0 {
+		return p.Memory.GetAsset(name, writer)
+	}
+	var buff bytes.Buffer
+	err := p.Memory.GetAsset(name, &buff)
+	if err != nil {
+		return err
+	}
+	writer.Write(buff.Bytes()[:p.failAfter])
+	return errors.New("Connection lost")
+}
+
+func testArchive(t *testing.T, files map[string]string) []byte {
+	var buff bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buff)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for name, content := range files {
+		mode := int64(0660)
+		if strings.HasSuffix(name, ".sh") {
+			mode = 0770
+		}
+		err := tarWriter.WriteHeader(&tar.Header{Name: name, Mode: mode, Size: int64(len(content)), Typeflag: tar.TypeReg})
+		if err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write([]byte(content))
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	return buff.Bytes()
+}
+
+func TestDownloadAtomic(t *testing.T) {
+	defer deleteTestAssets()
+	v := types.Version{Name: "atomic"}
+	archive := testArchive(t, map[string]string{"a/b.txt": "B", "run.sh": "#!/bin/sh"})
+	p := &failingProvider{Memory: memory.New(), failAfter: len(archive) / 2}
+	p.PushAsset("atomic.tar.gz", bytes.NewReader(archive))
+
+	_, err := download(p, v, Limits{})
+	if err == nil {
+		t.Fatal("Expected error")
+	}
+	if _, err := os.Stat("assets/atomic"); !os.IsNotExist(err) {
+		t.Fatal("Partial download left in place", err)
+	}
+	entries, _ := ioutil.ReadDir("assets")
+	if len(entries) != 0 {
+		t.Fatal("Staging folder not removed", entries)
+	}
+
+	p.failAfter = 0
+	exe, err := download(p, v, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe != "assets/atomic/run.sh" {
+		t.Fatal(exe)
+	}
+	if _, err := os.Stat("assets/atomic.complete"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Completed downloads are reused
+	p.DeleteAsset("atomic.tar.gz")
+	exe, err = download(p, v, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe != "assets/atomic/run.sh" {
+		t.Fatal(exe)
+	}
+}
+
+// racingProvider runs race before GetAsset, like another runner downloading the same version meanwhile
+type racingProvider struct {
+	*memory.Memory
+	race func()
+}
+
+func (p *racingProvider) GetAsset(name string, writer io.Writer) error {
+	if race := p.race; race != nil {
+		p.race = nil
+		race()
+	}
+	return p.Memory.GetAsset(name, writer)
+}
+
+func TestDownloadConcurrent(t *testing.T) {
+	defer deleteTestAssets()
+	v := types.Version{Name: "concurrent"}
+	p := &racingProvider{Memory: memory.New()}
+	p.PushAsset("concurrent.tar.gz", bytes.NewReader(testArchive(t, map[string]string{"a/b.txt": "B", "run.sh": "#!/bin/sh"})))
+
+	// Leftovers of an interrupted download are replaced
+	err := os.MkdirAll("assets/concurrent/leftover", 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The version completed by another runner is reused, it may be running from it
+	p.race = func() {
+		_, err := download(p, v, Limits{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile("assets/concurrent/running", nil, 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	exe, err := download(p, v, Limits{})
+	if err != nil || exe != "assets/concurrent/run.sh" {
+		t.Fatal(exe, err)
+	}
+	if _, err := os.Stat("assets/concurrent/running"); err != nil {
+		t.Fatal("The completed version was replaced", err)
+	}
+	if _, err := os.Stat("assets/concurrent/leftover"); !os.IsNotExist(err) {
+		t.Fatal("Leftover not replaced", err)
+	}
+	entries, _ := ioutil.ReadDir("assets")
+	if len(entries) != 2 {
+		t.Fatal("Staging folders not removed", entries)
+	}
+}
+
+func TestDownloadEntrypoint(t *testing.T) {
+	defer deleteTestAssets()
+	p := memory.New()
+	p.PushAsset("entrypoint.tar.gz", bytes.NewReader(testArchive(t, map[string]string{
+		"a.sh": "#!/bin/sh", "bin/b.sh": "#!/bin/sh", "c.txt": "C"})))
+
+	exe, err := download(p, types.Version{Name: "entrypoint", Entrypoint: "bin/b.sh"}, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if exe != "assets/entrypoint/bin/b.sh" {
+		t.Fatal(exe)
+	}
+
+	// Versions whose entrypoint isn't an executable can't be run, they aren't marked as complete
+	for i, entrypoint := range []string{"c.txt", "missing.sh", "bin", "../a.sh"} {
+		name := fmt.Sprint("entrypoint-", i)
+		p.PushAsset(name+".tar.gz", bytes.NewReader(testArchive(t, map[string]string{"bin/b.sh": "#!/bin/sh", "c.txt": "C"})))
+		exe, err = download(p, types.Version{Name: name, Entrypoint: entrypoint}, Limits{})
+		if !errors.Is(err, types.ErrNoExecutable) || exe != "" {
+			t.Fatal("Expected no executable error", entrypoint, exe, err)
+		}
+		if _, err := os.Stat(filepath.Join(assetsFolder, name+completeSuffix)); !os.IsNotExist(err) {
+			t.Fatal("The version was marked as complete", entrypoint, err)
+		}
+	}
+}
+
+func TestCheckEntrypointRecordedMode(t *testing.T) {
+	defer os.RemoveAll("test-entrypoint")
+	os.MkdirAll("test-entrypoint", 0770)
+	// Extracted files don't have executable bits on Windows, the modes recorded in the archive are checked
+	for _, name := range []string{"a.sh", "b.exe"} {
+		err := ioutil.WriteFile(filepath.Join("test-entrypoint", name), []byte("#!/bin/sh"), 0660)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	name, err := checkEntrypoint("test-entrypoint", "a.sh", []string{"a.sh"})
+	if err != nil || name != "a.sh" {
+		t.Fatal(name, err)
+	}
+	_, err = checkEntrypoint("test-entrypoint", "a.sh", nil)
+	if err == nil {
+		t.Fatal("Expected not executable error")
+	}
+	// .exe files are executable on Windows even if their mode wasn't recorded
+	_, err = checkEntrypoint("test-entrypoint", "b.exe", nil)
+	if (err == nil) != (runtime.GOOS == "windows") {
+		t.Fatal(runtime.GOOS, err)
+	}
+}
+
+func TestCleanPartialDownloads(t *testing.T) {
+	defer deleteTestAssets()
+	err := os.MkdirAll("assets/"+partialPrefix+"leftover/folder", 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.MkdirAll("assets/"+partialPrefix+"in-progress/folder", 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := time.Now().Add(-2 * partialStaleAge)
+	for _, name := range []string{"leftover/folder", "leftover", "in-progress"} {
+		err = os.Chtimes("assets/"+partialPrefix+name, old, old)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	cleanPartialDownloads()
+	if _, err := os.Stat("assets/" + partialPrefix + "leftover"); !os.IsNotExist(err) {
+		t.Fatal("Partial download not removed", err)
+	}
+	// The folder of a download in progress was recently changed
+	if _, err := os.Stat("assets/" + partialPrefix + "in-progress"); err != nil {
+		t.Fatal("Download in progress removed", err)
+	}
+}
+
+func testRawArchive(t *testing.T, headers ...*tar.Header) []byte {
+	var buff bytes.Buffer
+	gzipWriter := gzip.NewWriter(&buff)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, h := range headers {
+		err := tarWriter.WriteHeader(h)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.Typeflag == tar.TypeReg {
+			tarWriter.Write(bytes.Repeat([]byte("x"), int(h.Size)))
+		}
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+	return buff.Bytes()
+}
+
+func TestUntarRejectsUnsafeEntries(t *testing.T) {
+	defer os.RemoveAll("test-untar")
+	unsafe := map[string][]*tar.Header{
+		"parent":          {{Name: "../evil", Mode: 0660, Typeflag: tar.TypeReg}},
+		"nested parent":   {{Name: "a/../../evil", Mode: 0660, Typeflag: tar.TypeReg}},
+		"absolute":        {{Name: "/tmp/evil", Mode: 0660, Typeflag: tar.TypeReg}},
+		"windows parent":  {{Name: `..\evil`, Mode: 0660, Typeflag: tar.TypeReg}},
+		"windows volume":  {{Name: `C:\evil`, Mode: 0660, Typeflag: tar.TypeReg}},
+		"symlink outside": {{Name: "link", Linkname: "../..", Typeflag: tar.TypeSymlink}},
+		"symlink abs":     {{Name: "link", Linkname: "/etc/passwd", Typeflag: tar.TypeSymlink}},
+		"through symlink": {
+			{Name: "link", Linkname: ".", Typeflag: tar.TypeSymlink},
+			{Name: "link/evil", Mode: 0660, Typeflag: tar.TypeReg}},
+		"hardlink outside": {{Name: "link", Linkname: "../../etc/passwd", Typeflag: tar.TypeLink}},
+		"symlink through symlink": {
+			{Name: "a/b/l", Linkname: "..", Typeflag: tar.TypeSymlink},
+			{Name: "a/b/l2", Linkname: "l/../../..", Typeflag: tar.TypeSymlink}},
+		"hardlink to symlink": {
+			{Name: "a/l", Linkname: "../evil", Typeflag: tar.TypeSymlink},
+			{Name: "l2", Linkname: "a/l", Typeflag: tar.TypeLink}},
+		"device": {{Name: "dev", Mode: 0660, Typeflag: tar.TypeChar, Devmajor: 1, Devminor: 3}},
+		"fifo":   {{Name: "fifo", Mode: 0660, Typeflag: tar.TypeFifo}},
+	}
+	for name, headers := range unsafe {
+		os.RemoveAll("test-untar")
+		os.MkdirAll("test-untar/folder", 0770)
+		_, err := untar(bytes.NewReader(testRawArchive(t, headers...)), codecs["gzip"], "test-untar/folder", Limits{})
+		if err == nil {
+			t.Error("Expected error:", name)
+		}
+		if _, err := os.Lstat("test-untar/evil"); err == nil {
+			t.Error("File written outside the folder:", name)
+		}
+	}
+}
+
+func TestUntarNormalises(t *testing.T) {
+	defer os.RemoveAll("test-untar")
+	os.MkdirAll("test-untar", 0770)
+	archive := testRawArchive(t,
+		&tar.Header{Name: "./a/../b/setuid", Mode: 04755, Size: 3, Typeflag: tar.TypeReg},
+		&tar.Header{Name: "b/link", Linkname: "setuid", Typeflag: tar.TypeSymlink},
+	)
+	executables, err := untar(bytes.NewReader(archive), codecs["gzip"], "test-untar", Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(executables) != 1 || executables[0] != "b/setuid" {
+		t.Fatal(executables)
+	}
+	fi, err := os.Stat("test-untar/b/link")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode()&(os.ModeSetuid|os.ModeSetgid) != 0 {
+		t.Fatal("Setuid bit not stripped", fi.Mode())
+	}
+}
+
+func TestUntarLimits(t *testing.T) {
+	defer os.RemoveAll("test-untar")
+	os.MkdirAll("test-untar", 0770)
+	archive := testRawArchive(t,
+		&tar.Header{Name: "a", Mode: 0660, Size: 10, Typeflag: tar.TypeReg},
+		&tar.Header{Name: "b", Mode: 0660, Size: 10, Typeflag: tar.TypeReg},
+	)
+	_, err := untar(bytes.NewReader(archive), codecs["gzip"], "test-untar", Limits{MaxSize: 15})
+	if err == nil {
+		t.Fatal("Expected size limit error")
+	}
+	_, err = untar(bytes.NewReader(archive), codecs["gzip"], "test-untar", Limits{MaxFiles: 1})
+	if err == nil {
+		t.Fatal("Expected file count limit error")
+	}
+	_, err = untar(bytes.NewReader(archive), codecs["gzip"], "test-untar", Limits{MaxSize: 20, MaxFiles: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -56,6 +56,8 @@ func createTestAssets() {
 	}
 	err = ioutil.WriteFile("test-asset-failure-script", []byte(
 		`#!/bin/sh
+		# Give Stop time to kill the restarted execution before it writes its output
+		sleep 0.3
 		echo "I ran" >> ../test-script-output
 		exit 123`), 0770)
 	if err != nil {
@@ -0,0 +1,156 @@
+package dsdl
+
+import (
+	"errors"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// GCPolicy selects the archived versions kept by GC
+// A version is kept if any rule matches it, the current version is always kept
+// Zero values disable their rule
+type GCPolicy struct {
+	// KeepLast keeps the N most recent versions
+	KeepLast int
+	// KeepNewerThan keeps the versions uploaded during the last KeepNewerThan
+	KeepNewerThan time.Duration
+	// DryRun reports the garbage without deleting it
+	DryRun bool
+}
+
+// GCResult lists the deleted assets (or the assets that would be deleted on dry runs)
+type GCResult struct {
+	Deleted []types.Asset
+	Bytes   int64
+}
+
+// GC removes the archived versions of service which aren't kept by policy
+// Blobs are removed once no kept version references them
+// Versions and blobs uploaded during the last hour are always kept, they may belong to a deploy in progress
+func GC(service string, policy GCPolicy) (GCResult, error) {
+	p, err := getProviderFromService(service)
+	if err != nil {
+		return GCResult{}, err
+	}
+	m, ok := p.(types.AssetManager)
+	if !ok {
+		return GCResult{}, errors.New("Service doesn't support listing and deleting assets: " + RedactService(service))
+	}
+
+	current, err := p.GetCurrentVersion()
+	if err != nil {
+		return GCResult{}, err
+	}
+	assets, err := m.ListAssets()
+	if err != nil {
+		return GCResult{}, err
+	}
+
+	var blobs, archived []types.Asset
+	for _, a := range assets {
+		if blobHash(a.Name) != "" {
+			blobs = append(blobs, a)
+		} else {
+			archived = append(archived, a)
+		}
+	}
+	now := time.Now()
+	garbage := selectGarbage(archived, current, policy, now)
+	referenced, err := referencedBlobs(p, archived, garbage)
+	if err != nil {
+		return GCResult{}, err
+	}
+	garbage = append(garbage, selectBlobGarbage(blobs, referenced, now)...)
+
+	var result GCResult
+	for _, a := range garbage {
+		if !policy.DryRun {
+			err = m.DeleteAsset(a.Name)
+			if err != nil {
+				return result, err
+			}
+		}
+		result.Deleted = append(result.Deleted, a)
+		result.Bytes += a.Size
+	}
+	return result, nil
+}
+
+// selectGarbage returns the assets not kept by policy, keeping the versions younger than blobGracePeriod
+// Assets are grouped by version name, the first part of the asset name up to the first dot
+func selectGarbage(assets []types.Asset, current types.Version, policy GCPolicy, now time.Time) []types.Asset {
+	type version struct {
+		name   string
+		time   time.Time
+		assets []types.Asset
+	}
+	versions := make(map[string]*version)
+	for _, a := range assets {
+		name := strings.SplitN(a.Name, ".", 2)[0]
+		v, ok := versions[name]
+		if !ok {
+			v = &version{name: name}
+			versions[name] = v
+		}
+		if a.Time.After(v.time) {
+			v.time = a.Time
+		}
+		v.assets = append(v.assets, a)
+	}
+
+	var sorted []*version
+	for _, v := range versions {
+		sorted = append(sorted, v)
+	}
+	sort.Slice(sorted, func(i, j int) bool {
+		return sorted[i].time.After(sorted[j].time)
+	})
+
+	var garbage []types.Asset
+	for i, v := range sorted {
+		if v.name == current.Name ||
+			now.Sub(v.time) < blobGracePeriod ||
+			i < policy.KeepLast ||
+			(policy.KeepNewerThan > 0 && now.Sub(v.time) < policy.KeepNewerThan) {
+			continue
+		}
+		garbage = append(garbage, v.assets...)
+	}
+	return garbage
+}
+
+// referencedBlobs returns the hashes of the blobs referenced by the manifests of assets which aren't garbage
+func referencedBlobs(p types.Provider, assets, garbage []types.Asset) (map[string]bool, error) {
+	deleted := make(map[string]bool)
+	for _, a := range garbage {
+		deleted[a.Name] = true
+	}
+	referenced := make(map[string]bool)
+	for _, a := range assets {
+		if deleted[a.Name] || !strings.HasSuffix(a.Name, manifestExtension) {
+			continue
+		}
+		m, err := readManifest(p, a.Name)
+		if err != nil {
+			return nil, err
+		}
+		for _, f := range m.Files {
+			referenced[f.Blob] = true
+		}
+	}
+	return referenced, nil
+}
+
+// selectBlobGarbage returns the blobs which aren't referenced, keeping the ones younger than blobGracePeriod
+func selectBlobGarbage(blobs []types.Asset, referenced map[string]bool, now time.Time) []types.Asset {
+	var garbage []types.Asset
+	for _, a := range blobs {
+		if !referenced[blobHash(a.Name)] && now.Sub(a.Time) >= blobGracePeriod {
+			garbage = append(garbage, a)
+		}
+	}
+	return garbage
+}
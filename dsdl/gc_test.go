@@ -0,0 +1,99 @@
+package dsdl
+
+import (
+	"io/ioutil"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+func TestSelectGarbage(t *testing.T) {
+	now := time.Now()
+	assets := []types.Asset{
+		{Name: "a.tar.gz", Size: 1, Time: now.Add(-4 * time.Hour)},
+		{Name: "b.tar.gz", Size: 2, Time: now.Add(-3 * time.Hour)},
+		{Name: "c.tar.gz", Size: 3, Time: now.Add(-2 * time.Hour)},
+		{Name: "d.tar.gz", Size: 4, Time: now.Add(-1 * time.Hour)},
+		{Name: "e.tar.gz", Size: 5, Time: now.Add(-10 * time.Minute)},
+	}
+	current := types.Version{Name: "a"}
+
+	checkGarbage := func(policy GCPolicy, expected ...string) {
+		garbage := selectGarbage(assets, current, policy, now)
+		if len(garbage) != len(expected) {
+			t.Fatal(policy, garbage)
+		}
+		for i := range expected {
+			if garbage[i].Name != expected[i] {
+				t.Fatal(policy, garbage)
+			}
+		}
+	}
+	checkGarbage(GCPolicy{}, "d.tar.gz", "c.tar.gz", "b.tar.gz")
+	// The versions younger than blobGracePeriod are always kept, their deploys may be in progress
+	checkGarbage(GCPolicy{KeepLast: 1}, "d.tar.gz", "c.tar.gz", "b.tar.gz")
+	checkGarbage(GCPolicy{KeepNewerThan: 150 * time.Minute}, "b.tar.gz")
+	checkGarbage(GCPolicy{KeepLast: 2, KeepNewerThan: 30 * time.Minute}, "c.tar.gz", "b.tar.gz")
+	checkGarbage(GCPolicy{KeepLast: 10})
+}
+
+func TestGCBlobs(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	service := testService(t, "service")
+	target := Target{Name: "test", Service: service, Patterns: testPatterns, Blobs: true}
+	v1, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile("test-asset-basic-2", []byte("AssetB2"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The new version and the unreferenced blobs are kept during the grace period
+	result, err := GC(service, GCPolicy{KeepLast: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Deleted) != 0 {
+		t.Fatal(result)
+	}
+
+	p := syncTestProvider(t, service)
+	current, err := p.GetCurrentVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	assets, err := p.ListAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var blobs, archived []types.Asset
+	for _, a := range assets {
+		if blobHash(a.Name) != "" {
+			blobs = append(blobs, a)
+		} else {
+			archived = append(archived, a)
+		}
+	}
+	later := time.Now().Add(blobGracePeriod)
+	garbage := selectGarbage(archived, current, GCPolicy{KeepLast: 1}, later)
+	if len(garbage) != 1 || garbage[0].Name != v1.Name+manifestExtension {
+		t.Fatal(garbage)
+	}
+	referenced, err := referencedBlobs(p, archived, garbage)
+	if err != nil {
+		t.Fatal(err)
+	}
+	garbage = selectBlobGarbage(blobs, referenced, later)
+	hash, _ := hashFile("test-asset-basic-2")
+	if len(blobs) != 8 || len(garbage) != 1 || blobHash(garbage[0].Name) == hash {
+		t.Fatal(blobs, garbage)
+	}
+}
@@ -0,0 +1,46 @@
+package dsdl
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"strings"
+)
+
+// Hook is a command run by Deploy, its output is streamed to the console
+type Hook struct {
+	// Command is the program and its arguments, it isn't run through a shell
+	Command []string
+	// Dir is the working folder, the current folder by default
+	Dir string `json:",omitempty"`
+	// Env is added to the environment, as KEY=value
+	Env []string `json:",omitempty"`
+}
+
+func (h Hook) String() string {
+	return strings.Join(h.Command, " ")
+}
+
+// runHooks runs hooks in order, stopping at the first failure
+// The environment of every hook has env and the hook's Env
+func runHooks(hooks []Hook, env []string) error {
+	for _, h := range hooks {
+		if len(h.Command) == 0 {
+			return errors.New("Hook without command")
+		}
+		log.Println("Running", h)
+		cmd := exec.Command(h.Command[0], h.Command[1:]...)
+		cmd.Dir = h.Dir
+		cmd.Env = append(append(os.Environ(), env...), h.Env...)
+		cmd.Stdin = os.Stdin
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+		err := cmd.Run()
+		if err != nil {
+			return fmt.Errorf("Hook %s failed: %w", h, err)
+		}
+	}
+	return nil
+}
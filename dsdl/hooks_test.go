@@ -0,0 +1,66 @@
+package dsdl
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+func TestDeployHooks(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	defer os.Remove("test-asset-built")
+	defer os.Remove("test-hook-output")
+	target := Target{Name: "test", Service: "mem://deploy-hooks", Patterns: []string{"test-asset-built"},
+		Before: []Hook{
+			{Command: []string{"sh", "-c", "echo $BUILD > ../test-asset-built && chmod +x ../test-asset-built"},
+				Dir: "test-asset-basic-folder", Env: []string{"BUILD=built"}},
+		},
+		After: []Hook{{Command: []string{"sh", "-c", "echo $DSD_TARGET $DSD_VERSION > test-hook-output"}}},
+	}
+	v, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v.Files != 1 {
+		t.Fatal("The file built by the hook wasn't deployed", v.Files)
+	}
+	output, err := ioutil.ReadFile("test-hook-output")
+	if err != nil || string(output) != "test "+v.Name+"\n" {
+		t.Fatal(string(output), err)
+	}
+
+	// After hooks failures are reported, but the version is deployed
+	target.After = []Hook{{Command: []string{"false"}}}
+	v, err = Deploy(target, DeployConf{})
+	if err == nil || v.Name == "" {
+		t.Fatal(v, err)
+	}
+}
+
+func TestDeployBeforeHookFailure(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	defer os.Remove("test-hook-output")
+	target := Target{Name: "test", Service: "mem://deploy-hooks-failure", Patterns: testPatterns,
+		Before: []Hook{{Command: []string{"false"}}},
+		After:  []Hook{{Command: []string{"sh", "-c", "echo after > test-hook-output"}}},
+	}
+	_, err := Deploy(target, DeployConf{})
+	if err == nil {
+		t.Fatal("Expected hook error")
+	}
+	versions, err := Versions(target.Service)
+	if err != nil || len(versions) != 0 {
+		t.Fatal("Deployed after a failed hook", versions, err)
+	}
+	if _, err := os.Stat("test-hook-output"); !os.IsNotExist(err) {
+		t.Fatal("After hook run after a failed deploy", err)
+	}
+
+	target.Before = []Hook{{}}
+	_, err = Deploy(target, DeployConf{})
+	if err == nil {
+		t.Fatal("Expected hook error")
+	}
+}
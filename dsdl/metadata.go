@@ -0,0 +1,45 @@
+package dsdl
+
+import (
+	"os"
+	"os/user"
+
+	"github.com/davidmanzanares/dsd/types"
+	"github.com/go-git/go-git/v5"
+)
+
+// deployMetadata returns a version with the metadata of a deploy from the current folder
+// Metadata which can't be detected is left empty
+func deployMetadata(conf DeployConf) types.Version {
+	v := types.Version{Message: conf.Message, Meta: conf.Meta}
+	if u, err := user.Current(); err == nil {
+		v.User = u.Username
+	} else {
+		v.User = os.Getenv("USER")
+	}
+	v.Hostname, _ = os.Hostname()
+	v.Git = gitInfo(".")
+	return v
+}
+
+// gitInfo describes the git checkout containing folder, it returns nil if there isn't any
+func gitInfo(folder string) *types.GitInfo {
+	repo, err := git.PlainOpenWithOptions(folder, &git.PlainOpenOptions{DetectDotGit: true})
+	if err != nil {
+		return nil
+	}
+	head, err := repo.Head()
+	if err != nil {
+		return nil
+	}
+	info := &types.GitInfo{Commit: head.Hash().String()}
+	if head.Name().IsBranch() {
+		info.Branch = head.Name().Short()
+	}
+	if w, err := repo.Worktree(); err == nil {
+		if status, err := w.Status(); err == nil {
+			info.Dirty = !status.IsClean()
+		}
+	}
+	return info
+}
@@ -0,0 +1,60 @@
+package dsdl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func TestGitInfo(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsd-git-info-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if info := gitInfo(dir); info != nil {
+		t.Fatal("Unexpected checkout", info)
+	}
+
+	repo, err := git.PlainInit(dir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(filepath.Join(dir, "a"), []byte("a"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := repo.Worktree()
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Add("a")
+	hash, err := w.Commit("a", &git.CommitOptions{Author: &object.Signature{Name: "test", When: time.Now()}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Subfolders are detected too
+	err = os.Mkdir(filepath.Join(dir, "sub"), 0770)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := gitInfo(filepath.Join(dir, "sub"))
+	if info == nil || info.Commit != hash.String() || info.Branch != "master" || info.Dirty {
+		t.Fatal(info)
+	}
+
+	err = ioutil.WriteFile(filepath.Join(dir, "a"), []byte("b"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	info = gitInfo(dir)
+	if info == nil || !info.Dirty {
+		t.Fatal("Expected dirty checkout", info)
+	}
+}
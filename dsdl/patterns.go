@@ -0,0 +1,103 @@
+package dsdl
+
+import (
+	"bufio"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/bmatcuk/doublestar/v2"
+	"github.com/go-git/go-git/v5/plumbing/format/gitignore"
+)
+
+// ignoreFile lists the files which are never deployed, with gitignore syntax
+const ignoreFile = ".dsdignore"
+
+// matchPatterns resolves patterns into the matched paths, in pattern order, and the patterns which matched nothing
+// Patterns support recursive "**" globs, "!" prefixed patterns exclude the paths they match (or which are
+// inside a folder they match) from every other pattern
+// Paths ignored by the .dsdignore file of the current folder are excluded too
+func matchPatterns(patterns []string) ([]string, []string, error) {
+	ignored, err := loadIgnoreFile(ignoreFile)
+	if err != nil {
+		return nil, nil, err
+	}
+	var includes, excludes []string
+	for _, p := range patterns {
+		if strings.HasPrefix(p, "!") {
+			excludes = append(excludes, p[1:])
+		} else {
+			includes = append(includes, p)
+		}
+	}
+
+	var matches, unmatched []string
+	for _, p := range includes {
+		found, err := doublestar.Glob(p)
+		if err != nil {
+			return nil, nil, err
+		}
+		if len(found) == 0 {
+			unmatched = append(unmatched, p)
+		}
+		for _, match := range found {
+			excluded, err := isExcluded(match, excludes)
+			if err != nil {
+				return nil, nil, err
+			}
+			if excluded || (ignored != nil && isIgnored(match, ignored)) {
+				continue
+			}
+			matches = append(matches, match)
+		}
+	}
+	return matches, unmatched, nil
+}
+
+// isExcluded returns true if any exclude pattern matches name or one of its parent folders
+func isExcluded(name string, excludes []string) (bool, error) {
+	for dir := filepath.Clean(name); dir != "." && dir != string(filepath.Separator); dir = filepath.Dir(dir) {
+		for _, p := range excludes {
+			match, err := doublestar.PathMatch(filepath.Clean(p), dir)
+			if err != nil {
+				return false, err
+			}
+			if match {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
+
+// isIgnored returns true if name is ignored by m
+func isIgnored(name string, m gitignore.Matcher) bool {
+	fi, err := os.Stat(name)
+	isDir := err == nil && fi.IsDir()
+	return m.Match(strings.Split(filepath.ToSlash(filepath.Clean(name)), "/"), isDir)
+}
+
+// loadIgnoreFile returns the matcher of the gitignore-like file filename, or nil if it doesn't exist
+func loadIgnoreFile(filename string) (gitignore.Matcher, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var ps []gitignore.Pattern
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.TrimSpace(line) == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		ps = append(ps, gitignore.ParsePattern(line, nil))
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return gitignore.NewMatcher(ps), nil
+}
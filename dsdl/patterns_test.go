@@ -0,0 +1,54 @@
+package dsdl
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+func planNames(t *testing.T, patterns ...string) string {
+	plan, err := planFiles(patterns)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range plan.Files {
+		names = append(names, f.Name)
+	}
+	return strings.Join(names, ",")
+}
+
+func TestPatterns(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+
+	names := planNames(t, "test-asset-basic-folder/**")
+	if names != "test-asset-basic-folder/folder2/test-asset-4,test-asset-basic-folder/test-asset-3" {
+		t.Fatal(names)
+	}
+	names = planNames(t, "**/test-asset-4")
+	if names != "test-asset-basic-folder/folder2/test-asset-4" {
+		t.Fatal(names)
+	}
+	// Excludes apply to every pattern, files inside excluded folders are excluded too
+	names = planNames(t, "!*-script", "test-asset*", "test-asset*/**", "!**/folder2")
+	if names != "test-asset-basic-1,test-asset-basic-2,test-asset-basic-folder/test-asset-3" {
+		t.Fatal(names)
+	}
+}
+
+func TestPatternsIgnoreFile(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	err := ioutil.WriteFile(ignoreFile, []byte("# Comment\n\n*-script\nfolder2/\n!test-asset-failure-script\n"), 0660)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ignoreFile)
+
+	names := planNames(t, testPatterns...)
+	if names != "test-asset-basic-1,test-asset-basic-2,test-asset-failure-script,test-asset-basic-folder/test-asset-3" {
+		t.Fatal(names)
+	}
+}
@@ -0,0 +1,150 @@
+package dsdl
+
+import (
+	"io"
+	"time"
+
+	"github.com/davidmanzanares/dsd/internal/fileio"
+)
+
+// progressInterval is the minimum time between progress reports while reading files
+const progressInterval = 100 * time.Millisecond
+
+// Progress reports the state of a deploy
+type Progress struct {
+	// Platform is the platform of the archive being packed, it's empty on single archive targets
+	Platform string
+	// Files is the number of packed files, out of TotalFiles
+	Files      int
+	TotalFiles int
+	// Bytes is the number of read bytes of the deployed files, out of TotalBytes
+	Bytes      int64
+	TotalBytes int64
+	// Uploaded is the number of compressed bytes uploaded
+	Uploaded int64
+	Elapsed  time.Duration
+	// Done is set on the last report, once the version is pushed
+	Done bool
+}
+
+// Throughput returns the number of read bytes per second
+func (p Progress) Throughput() float64 {
+	if p.Elapsed <= 0 {
+		return 0
+	}
+	return float64(p.Bytes) / p.Elapsed.Seconds()
+}
+
+// ETA returns the estimated time to read the remaining bytes, or 0 if it's unknown
+func (p Progress) ETA() time.Duration {
+	throughput := p.Throughput()
+	if throughput == 0 {
+		return 0
+	}
+	return time.Duration(float64(p.TotalBytes-p.Bytes) / throughput * float64(time.Second))
+}
+
+// progressReporter calls the progress callback of a deploy, a nil reporter doesn't report anything
+type progressReporter struct {
+	callback func(Progress)
+	progress Progress
+	start    time.Time
+	last     time.Time
+	// archive counts the uploaded bytes of the current archive, uploaded has the bytes of the previous archives
+	archive  *fileio.CountingWriter
+	uploaded int64
+}
+
+func newProgressReporter(callback func(Progress), plans []Plan) *progressReporter {
+	if callback == nil {
+		return nil
+	}
+	r := &progressReporter{callback: callback, start: time.Now()}
+	for _, plan := range plans {
+		r.progress.TotalFiles += len(plan.Files)
+		for _, f := range plan.Files {
+			r.progress.TotalBytes += f.Size
+		}
+	}
+	return r
+}
+
+// startArchive reports the packing of a new archive, whose uploaded bytes are counted by archive
+func (r *progressReporter) startArchive(platform string, archive *fileio.CountingWriter) {
+	if r == nil {
+		return
+	}
+	if r.archive != nil {
+		r.uploaded += r.archive.N
+	}
+	r.archive = archive
+	r.progress.Platform = platform
+	r.report(true)
+}
+
+// save returns the current progress, to restore it when an upload is restarted
+func (r *progressReporter) save() Progress {
+	if r == nil {
+		return Progress{}
+	}
+	return r.progress
+}
+
+// restore sets the progress saved before a restarted upload
+func (r *progressReporter) restore(saved Progress) {
+	if r == nil {
+		return
+	}
+	r.progress = saved
+}
+
+func (r *progressReporter) read(n int) {
+	if r == nil {
+		return
+	}
+	r.progress.Bytes += int64(n)
+	r.report(false)
+}
+
+func (r *progressReporter) fileDone() {
+	if r == nil {
+		return
+	}
+	r.progress.Files++
+	r.report(true)
+}
+
+func (r *progressReporter) done() {
+	if r == nil {
+		return
+	}
+	r.progress.Done = true
+	r.report(true)
+}
+
+// report calls the callback, if force isn't set it's skipped if the last call was too recent
+func (r *progressReporter) report(force bool) {
+	now := time.Now()
+	if !force && now.Sub(r.last) < progressInterval {
+		return
+	}
+	r.last = now
+	r.progress.Elapsed = now.Sub(r.start)
+	r.progress.Uploaded = r.uploaded
+	if r.archive != nil {
+		r.progress.Uploaded += r.archive.N
+	}
+	r.callback(r.progress)
+}
+
+// progressReader reports the bytes read from r
+type progressReader struct {
+	r        io.Reader
+	reporter *progressReporter
+}
+
+func (p progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.reporter.read(n)
+	return n, err
+}
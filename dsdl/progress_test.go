@@ -0,0 +1,63 @@
+package dsdl
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDeployProgress(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	var reports []Progress
+	target := Target{Name: "test", Service: "mem://deploy-progress", Patterns: testPatterns}
+	v, err := Deploy(target, DeployConf{Progress: func(p Progress) {
+		reports = append(reports, p)
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reports) < 2 {
+		t.Fatal(reports)
+	}
+	for i := 1; i < len(reports); i++ {
+		if reports[i].Files < reports[i-1].Files || reports[i].Bytes < reports[i-1].Bytes || reports[i].Done != (i == len(reports)-1) {
+			t.Fatal("Unexpected progress", reports[i-1], reports[i])
+		}
+	}
+	last := reports[len(reports)-1]
+	if last.Files != v.Files || last.TotalFiles != v.Files || last.Bytes != last.TotalBytes || last.TotalBytes == 0 || last.Uploaded != v.Size {
+		t.Fatal(last, v.Files, v.Size)
+	}
+}
+
+func TestDeployProgressPlatforms(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	var last Progress
+	platforms := make(map[string]bool)
+	target := Target{Name: "test", Service: "mem://deploy-progress-platforms", Patterns: testPatterns,
+		Platforms: map[string]Platform{"linux": {}, "windows": {}}}
+	v, err := Deploy(target, DeployConf{Progress: func(p Progress) {
+		platforms[p.Platform] = true
+		last = p
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !platforms["linux"] || !platforms["windows"] || len(platforms) != 2 {
+		t.Fatal(platforms)
+	}
+	if !last.Done || last.Files != v.Files || last.TotalFiles != v.Files || last.Uploaded != v.Size {
+		t.Fatal(last, v.Files, v.Size)
+	}
+}
+
+func TestProgressETA(t *testing.T) {
+	p := Progress{Bytes: 100, TotalBytes: 300, Elapsed: time.Second}
+	if p.Throughput() != 100 || p.ETA() != 2*time.Second {
+		t.Fatal(p.Throughput(), p.ETA())
+	}
+	if (Progress{TotalBytes: 300}).ETA() != 0 {
+		t.Fatal("The ETA is unknown before reading anything")
+	}
+}
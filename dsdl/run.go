@@ -1,6 +1,7 @@
 package dsdl
 
 import (
+	"errors"
 	"fmt"
 	"log"
 	"os"
@@ -17,11 +18,16 @@ type RunConf struct {
 	OnSuccess RunReaction
 	OnFailure RunReaction
 	Polling   time.Duration
+	// Limits bounds the downloaded archives, see DefaultLimits
+	Limits Limits
 }
 
 // DefaultPolling for Run when RunConf.Polling is set to the zero time.Duration
 const DefaultPolling = 5 * time.Second
 
+// minRetry is the first delay retrying updates after transient errors, it's doubled up to the polling interval
+const minRetry = time.Second
+
 // RunReaction is the action to take when the deployed application exits
 type RunReaction int
 
@@ -45,6 +51,13 @@ type Runner struct {
 	appExe         string
 	spawned        *os.Process
 	exit           chan exitType
+
+	// retry is set after transient errors, to update again before the next polling
+	retry   <-chan time.Time
+	backoff time.Duration
+	// skipVersion is a version without executables or unsupported by this version of dsd, it isn't downloaded again
+	skipVersion string
+	waiting     bool
 }
 type exitType struct {
 	code int
@@ -91,15 +104,21 @@ func Run(service string, conf RunConf) (*Runner, error) {
 	if err != nil {
 		return nil, err
 	}
+	return run(p, conf), nil
+}
 
+func run(p types.Provider, conf RunConf) *Runner {
 	if conf.Polling == 0 {
 		conf.Polling = DefaultPolling
 	}
 
+	conf.Limits = conf.Limits.withDefaults()
+
+	cleanPartialDownloads()
 	r := &Runner{events: make(chan RunEvent, 10), commands: make(chan string, 10), provider: p, conf: conf}
 	go r.manager()
 	r.commands <- "update"
-	return r, nil
+	return r
 }
 
 // WaitForEvent waits for the generation of the next RunEvent
@@ -118,6 +137,11 @@ func (r *Runner) Stop() {
 
 func (r *Runner) manager() {
 	defer close(r.events)
+	stopWatching := make(chan struct{})
+	defer close(stopWatching)
+	if w, ok := r.provider.(types.VersionWatcher); ok {
+		go r.watch(w, stopWatching)
+	}
 	for {
 		select {
 		case exit := <-r.exit:
@@ -144,10 +168,17 @@ func (r *Runner) manager() {
 			if r.conf.HotReload || r.spawned == nil {
 				r.update()
 			}
+		case <-r.retry:
+			r.retry = nil
+			r.update()
 		case cmd := <-r.commands:
 			if cmd == "update" {
 				r.update()
 				continue
+			} else if cmd == "poll" {
+				if r.conf.HotReload || r.spawned == nil {
+					r.update()
+				}
 			} else if cmd == "stop" {
 				r.kill()
 				return
@@ -157,6 +188,18 @@ func (r *Runner) manager() {
 		}
 	}
 }
+
+// watch polls the provider as soon as it notifies a new version, instead of waiting for the polling interval
+func (r *Runner) watch(w types.VersionWatcher, stop chan struct{}) {
+	for range w.WatchVersions(stop) {
+		select {
+		case r.commands <- "poll":
+		case <-stop:
+			return
+		}
+	}
+}
+
 func (r *Runner) kill() {
 	if r.spawned != nil {
 		// TODO call Interrupt first
@@ -174,27 +217,63 @@ func (r *Runner) kill() {
 	}
 }
 
+// update runs the current version if it changed
+// Transient errors are retried with an exponential backoff, without waiting for the next polling
 func (r *Runner) update() {
+	err := r.tryUpdate()
+	if errors.Is(err, types.ErrTransient) {
+		if r.backoff == 0 {
+			r.backoff = minRetry
+		} else {
+			r.backoff *= 2
+		}
+		if r.backoff > r.conf.Polling {
+			r.backoff = r.conf.Polling
+		}
+		r.retry = time.After(r.backoff)
+		log.Println(err, "- retrying in", r.backoff)
+		return
+	}
+	r.backoff = 0
+	if errors.Is(err, types.ErrUnauthorized) {
+		log.Println(err, "- check the service credentials")
+	} else if err != nil {
+		log.Println(err)
+	}
+}
+
+func (r *Runner) tryUpdate() error {
 	v, err := r.provider.GetCurrentVersion()
+	if errors.Is(err, types.ErrNotFound) {
+		if !r.waiting {
+			log.Println("Nothing deployed yet, waiting for the first deploy")
+			r.waiting = true
+		}
+		return nil
+	}
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
-	if v.Name == r.currentVersion.Name {
-		return
+	r.waiting = false
+	if v.Name == r.currentVersion.Name || v.Name == r.skipVersion {
+		return nil
+	}
+	exe, err := download(r.provider, v, r.conf.Limits)
+	// Versions which can't be run aren't downloaded again until a new version is deployed
+	if errors.Is(err, types.ErrNoExecutable) || errors.Is(err, types.ErrUnsupportedVersion) {
+		r.skipVersion = v.Name
 	}
-	exe, err := download(r.provider, v)
 	if err != nil {
-		log.Println(err)
-		return
+		return err
 	}
 	if exe == "" {
-		log.Println("Error, executable not found")
-		return
+		r.skipVersion = v.Name
+		return fmt.Errorf("Version %s can't be run: %w", v.Name, types.ErrNoExecutable)
 	}
 	r.appExe = exe
 	r.currentVersion = v
 	r.run("update")
+	return nil
 }
 
 func (r *Runner) run(reason string) {
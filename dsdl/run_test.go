@@ -1,6 +1,7 @@
 package dsdl
 
 import (
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"runtime"
@@ -8,21 +9,22 @@ import (
 	"testing"
 	"time"
 
+	"github.com/davidmanzanares/dsd/provider/memory"
 	"github.com/davidmanzanares/dsd/types"
 )
 
-var testPatterns []string = []string{"test-asset*", "*/*", "*/*/*"}
+var testPatterns []string = []string{"test-asset*", "test-asset*/**"}
 
 func TestRunBasic(t *testing.T) {
 	createTestAssets()
 	defer deleteTestAssets()
 
-	service := "s3://dsd-s3-test/tests"
-	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns})
+	service := "mem://tests"
+	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	r, err := Run("s3://dsd-s3-test/tests", RunConf{})
+	r, err := Run(service, RunConf{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -43,16 +45,16 @@ func TestRunBasic(t *testing.T) {
 }
 
 func TestRunFailureRestart(t *testing.T) {
-	var testPatterns []string = []string{"test-asset-failure-script", "*/*", "*/*/*"}
+	var testPatterns []string = []string{"test-asset-failure-script", "test-asset-basic-folder/**"}
 	createTestAssets()
 	defer deleteTestAssets()
 
-	service := "s3://dsd-s3-test/tests"
-	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns})
+	service := "mem://tests"
+	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	r, err := Run("s3://dsd-s3-test/tests", RunConf{OnFailure: Restart})
+	r, err := Run(service, RunConf{OnFailure: Restart})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -91,16 +93,16 @@ func TestRunFailureRestart(t *testing.T) {
 }
 
 func TestRunHotReload(t *testing.T) {
-	var testPatterns []string = []string{"test-asset-sleep-script", "*/*", "*/*/*"}
+	var testPatterns []string = []string{"test-asset-sleep-script", "test-asset-basic-folder/**"}
 	createTestAssets()
 	defer deleteTestAssets()
 
-	service := "s3://dsd-s3-test/tests"
-	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns})
+	service := "mem://tests"
+	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	r, err := Run("s3://dsd-s3-test/tests", RunConf{HotReload: true, Polling: 50 * time.Millisecond})
+	r, err := Run(service, RunConf{HotReload: true, Polling: 50 * time.Millisecond})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -110,7 +112,7 @@ func TestRunHotReload(t *testing.T) {
 	}
 	time.Sleep(50 * time.Millisecond)
 	checkExecution(t, v, 1)
-	v, err = Deploy(Target{Name: "test", Service: service, Patterns: testPatterns})
+	v, err = Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -131,12 +133,12 @@ func TestRunSuccessWait(t *testing.T) {
 	createTestAssets()
 	defer deleteTestAssets()
 
-	service := "s3://dsd-s3-test/tests"
-	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns})
+	service := "mem://tests"
+	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
 	if err != nil {
 		t.Fatal(err)
 	}
-	r, err := Run("s3://dsd-s3-test/tests", RunConf{OnSuccess: Wait})
+	r, err := Run(service, RunConf{OnSuccess: Wait})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -150,7 +152,7 @@ func TestRunSuccessWait(t *testing.T) {
 	}
 	checkFiles(v, t)
 	checkExecution(t, v, 1)
-	v, err = Deploy(Target{Name: "test", Service: service, Patterns: testPatterns})
+	v, err = Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -172,8 +174,76 @@ func TestRunSuccessWait(t *testing.T) {
 	}
 }
 
+// transientProvider returns transient errors for the first failures version requests
+type transientProvider struct {
+	types.Provider
+	failures int
+}
+
+func (p *transientProvider) GetCurrentVersion() (types.Version, error) {
+	if p.failures > 0 {
+		p.failures--
+		return types.Version{}, types.WrapError(types.ErrTransient, errors.New("Connection lost"))
+	}
+	return p.Provider.GetCurrentVersion()
+}
+
+func TestRunRetryTransient(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+
+	service := "mem://retry"
+	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := getProviderFromService(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The polling interval is too long, only retries can start the application
+	start := time.Now()
+	r := run(&transientProvider{Provider: p, failures: 2}, RunConf{OnSuccess: Wait, Polling: time.Hour})
+	ev := r.WaitForEvent()
+	if ev.Type != AppStarted || ev.Version.Name != v.Name {
+		t.Fatal(ev)
+	}
+	if elapsed := time.Since(start); elapsed < 3*minRetry {
+		t.Fatal("Retries don't back off", elapsed)
+	}
+	ev = r.WaitForEvent()
+	if ev.Type != AppExit {
+		t.Fatal(ev)
+	}
+	r.Stop()
+	ev = r.WaitForEvent()
+	if ev.Type != Stopped {
+		t.Fatal(ev)
+	}
+	checkExecution(t, v, 1)
+}
+
+func TestRunSkipUnsupported(t *testing.T) {
+	defer deleteTestAssets()
+	p := memory.New()
+	err := p.PushVersion(types.Version{Name: "unsupported", Codec: "lz4", Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Versions this version of dsd can't run are skipped instead of retried on every polling
+	r := &Runner{provider: p}
+	err = r.tryUpdate()
+	if !errors.Is(err, types.ErrUnsupportedVersion) || r.skipVersion != "unsupported" {
+		t.Fatal(r.skipVersion, err)
+	}
+	err = r.tryUpdate()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestDefaultPolling(t *testing.T) {
-	r, err := Run("s3://dsd-s3-test/tests", RunConf{OnSuccess: Wait})
+	r, err := Run("mem://polling", RunConf{OnSuccess: Wait})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -183,7 +253,7 @@ func TestDefaultPolling(t *testing.T) {
 	r.Stop()
 }
 func TestCustomPolling(t *testing.T) {
-	r, err := Run("s3://dsd-s3-test/tests", RunConf{OnSuccess: Wait, Polling: time.Minute})
+	r, err := Run("mem://polling", RunConf{OnSuccess: Wait, Polling: time.Minute})
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -0,0 +1,37 @@
+package dsdl
+
+import (
+	nethttp "net/http"
+
+	"github.com/davidmanzanares/dsd/provider/http"
+)
+
+// ServeConf is the configuration of Serve
+type ServeConf struct {
+	// Listen is the TCP address to listen on, like ":8080"
+	Listen string
+	// Token, if set, is required as a bearer token by every download
+	Token string
+	// UploadToken, if set, enables uploads authenticated with it as a bearer token
+	UploadToken string
+	// TLSCert and TLSKey, if set, are used to serve HTTPS
+	TLSCert string
+	TLSKey  string
+}
+
+// Serve exposes service over HTTP, it can be used with http(s):// services
+// It blocks until the server fails
+func Serve(service string, conf ServeConf) error {
+	p, err := getProviderFromService(service)
+	if err != nil {
+		return err
+	}
+	handler := http.NewServer(p, http.ServerConf{Token: conf.Token, UploadToken: conf.UploadToken})
+	defer handler.Close()
+
+	server := &nethttp.Server{Addr: conf.Listen, Handler: handler}
+	if conf.TLSCert != "" || conf.TLSKey != "" {
+		return server.ListenAndServeTLS(conf.TLSCert, conf.TLSKey)
+	}
+	return server.ListenAndServe()
+}
@@ -0,0 +1,62 @@
+package dsdl
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/provider/file"
+	"github.com/davidmanzanares/dsd/provider/http"
+)
+
+func TestServeHotReload(t *testing.T) {
+	var testPatterns []string = []string{"test-asset-sleep-script", "*/*", "*/*/*"}
+	createTestAssets()
+	defer deleteTestAssets()
+
+	dir, err := ioutil.TempDir("", "dsd-serve-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backend, err := file.Create("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := http.NewServer(backend, http.ServerConf{UploadToken: "secret"})
+	defer server.Close()
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	service := ts.URL + "#bearer=secret"
+	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The polling interval is too long, only server notifications can trigger the hot reload
+	r, err := Run(ts.URL, RunConf{HotReload: true, Polling: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev := r.WaitForEvent()
+	if ev.Type != AppStarted || ev.Version.Name != v.Name {
+		t.Fatal(ev)
+	}
+	v, err = Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ev = r.WaitForEvent()
+	if ev.Type != AppStarted || ev.Version.Name != v.Name {
+		t.Fatal(ev)
+	}
+	time.Sleep(50 * time.Millisecond)
+	checkExecution(t, v, 2)
+	r.Stop()
+	ev = r.WaitForEvent()
+	if ev.Type != Stopped {
+		t.Fatal(ev)
+	}
+}
@@ -3,15 +3,76 @@ package dsdl
 import (
 	"errors"
 	"fmt"
+	"regexp"
 	"strings"
 
+	"github.com/davidmanzanares/dsd/provider"
+	"github.com/davidmanzanares/dsd/provider/bundle"
+	"github.com/davidmanzanares/dsd/provider/file"
+	"github.com/davidmanzanares/dsd/provider/git"
+	"github.com/davidmanzanares/dsd/provider/http"
+	"github.com/davidmanzanares/dsd/provider/memory"
 	"github.com/davidmanzanares/dsd/provider/s3"
+	"github.com/davidmanzanares/dsd/provider/sftp"
 	"github.com/davidmanzanares/dsd/types"
 )
 
 func getProviderFromService(service string) (types.Provider, error) {
+	if strings.HasPrefix(service, "mirror:") {
+		return getMirror(strings.TrimPrefix(service, "mirror:"))
+	}
 	if strings.HasPrefix(service, "s3:") {
 		return s3.Create(service)
 	}
-	return nil, errors.New(fmt.Sprint("Unkown service:", service))
+	if strings.HasPrefix(service, "mem:") {
+		return memory.Create(service)
+	}
+	if strings.HasPrefix(service, "file:") {
+		return file.Create(service)
+	}
+	if strings.HasPrefix(service, "git+") {
+		return git.Create(service)
+	}
+	if strings.HasPrefix(service, "sftp:") {
+		return sftp.Create(service)
+	}
+	if strings.HasPrefix(service, "bundle:") {
+		return bundle.Create(service)
+	}
+	if strings.HasPrefix(service, "http:") || strings.HasPrefix(service, "https:") {
+		return http.Create(service)
+	}
+	return nil, fmt.Errorf("Unknown service %s: %w", RedactService(service), types.ErrUnknownScheme)
+}
+
+// secretOptions matches the service URL options holding credentials, in the query or in the fragment
+var secretOptions = regexp.MustCompile(`([?&#](?:access-key-id|secret-access-key|session-token|bearer|header)=)[^&#|]*`)
+
+// secretUserInfo matches the password of the service URL user info
+var secretUserInfo = regexp.MustCompile(`(://[^/?#@:|]*:)[^/?#@|]*@`)
+
+// RedactService returns service with the credentials of its URL replaced, services must be redacted before
+// printing them or passing them to other programs
+func RedactService(service string) string {
+	service = secretUserInfo.ReplaceAllString(service, "${1}REDACTED@")
+	return secretOptions.ReplaceAllString(service, "${1}REDACTED")
+}
+
+// getMirror returns a provider mirroring the services separated by "|", in priority order
+func getMirror(services string) (types.Provider, error) {
+	var backends []types.Provider
+	for _, service := range strings.Split(services, "|") {
+		if service == "" {
+			continue
+		}
+		p, err := getProviderFromService(service)
+		if err != nil {
+			return nil, err
+		}
+		backends = append(backends, p)
+	}
+	if len(backends) == 0 {
+		return nil, errors.New("Mirror services need at least one service")
+	}
+	return provider.Mirror(backends...), nil
 }
@@ -0,0 +1,213 @@
+package dsdl
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+
+	"github.com/davidmanzanares/dsd/internal/fileio"
+	"github.com/davidmanzanares/dsd/provider"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// SyncConf selects the versions copied by Sync
+type SyncConf struct {
+	// Version is the name of the copied version, the current version of the source by default
+	// Sources without history can only copy their current version
+	Version string
+	// All copies every version of the source history, oldest first, sources without history fail
+	All bool
+	// SetCurrent pushes the copied versions to the destination, making the last one its current version
+	// Otherwise only the assets are copied
+	SetCurrent bool
+}
+
+// SyncResult lists what Sync copied
+type SyncResult struct {
+	Versions []types.Version
+	// Assets are the copied assets, assets already stored on the destination with the same size aren't copied again
+	Assets []types.Asset
+	Bytes  int64
+}
+
+// Sync copies versions from one service to another, keeping their names and times
+// Every asset of a version is copied if the source can list its assets, otherwise only its archives are
+// The blobs referenced by blob versions are copied too
+func Sync(from, to string, conf SyncConf) (SyncResult, error) {
+	src, err := getProviderFromService(from)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	dst, err := getProviderFromService(to)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	src = provider.WithRetry(src, provider.DefaultRetryPolicy)
+	dst = provider.WithRetry(dst, provider.DefaultRetryPolicy)
+	return syncProviders(src, dst, conf)
+}
+
+// syncProviders copies the versions of src selected by conf to dst
+func syncProviders(src, dst types.Provider, conf SyncConf) (SyncResult, error) {
+	versions, err := syncVersions(src, conf)
+	if err != nil {
+		return SyncResult{}, err
+	}
+	var srcAssets, dstAssets []types.Asset
+	if m, ok := src.(types.AssetManager); ok {
+		srcAssets, err = m.ListAssets()
+		if err != nil {
+			return SyncResult{}, err
+		}
+	}
+	if m, ok := dst.(types.AssetManager); ok {
+		dstAssets, err = m.ListAssets()
+		if err != nil {
+			return SyncResult{}, err
+		}
+	}
+	stored := make(map[string]int64)
+	for _, a := range dstAssets {
+		stored[a.Name] = a.Size
+	}
+
+	var result SyncResult
+	for _, v := range versions {
+		assets := versionAssets(v, srcAssets)
+		if len(assets) == 0 {
+			return result, fmt.Errorf("Version %s has no assets: %w", v.Name, types.ErrNotFound)
+		}
+		if v.Blobs {
+			blobs, err := versionBlobs(src, v, srcAssets)
+			if err != nil {
+				return result, err
+			}
+			// The blobs are copied before the manifests referencing them
+			assets = append(blobs, assets...)
+		}
+		for _, a := range assets {
+			if size, ok := stored[a.Name]; ok && (size == a.Size || a.Size < 0) {
+				continue
+			}
+			n, err := copyAsset(src, dst, a.Name)
+			if err != nil {
+				return result, err
+			}
+			a.Size = n
+			stored[a.Name] = n
+			result.Assets = append(result.Assets, a)
+			result.Bytes += n
+		}
+		if conf.SetCurrent {
+			err = dst.PushVersion(v)
+			if err != nil {
+				return result, err
+			}
+		}
+		result.Versions = append(result.Versions, v)
+	}
+	return result, nil
+}
+
+// syncVersions returns the versions of p selected by conf, oldest first
+func syncVersions(p types.Provider, conf SyncConf) ([]types.Version, error) {
+	if conf.All && conf.Version != "" {
+		return nil, errors.New("A version and all versions can't be synced at the same time")
+	}
+	var history []types.Version
+	if h, ok := p.(types.VersionHistory); ok {
+		var err error
+		history, err = h.History()
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		current, err := p.GetCurrentVersion()
+		if err != nil {
+			return nil, err
+		}
+		// Only the current version is known
+		if conf.All || (conf.Version != "" && conf.Version != current.Name) {
+			return nil, fmt.Errorf("The service can't list its versions, only its current version %s can be synced", current.Name)
+		}
+		history = []types.Version{current}
+	}
+	if len(history) == 0 {
+		return nil, fmt.Errorf("Nothing deployed yet: %w", types.ErrNotFound)
+	}
+
+	if conf.All {
+		versions := make([]types.Version, len(history))
+		for i, v := range history {
+			versions[len(history)-1-i] = v
+		}
+		return versions, nil
+	}
+	if conf.Version == "" {
+		return history[:1], nil
+	}
+	for _, v := range history {
+		if v.Name == conf.Version {
+			return []types.Version{v}, nil
+		}
+	}
+	return nil, fmt.Errorf("Version %s: %w", conf.Version, types.ErrNotFound)
+}
+
+// versionAssets returns the assets of v found in assets, or just its archives if assets weren't listed
+// Unlisted assets have a negative size
+func versionAssets(v types.Version, assets []types.Asset) []types.Asset {
+	if assets == nil && len(v.Platforms) == 0 {
+		c, err := versionCodec(v)
+		if err != nil {
+			// The archive extension is unknown
+			return nil
+		}
+		return []types.Asset{{Name: archiveName(v, "", c), Size: -1, Time: v.Time}}
+	}
+	if assets == nil {
+		var archives []types.Asset
+		for _, a := range v.Platforms {
+			archives = append(archives, types.Asset{Name: a.Asset, Size: -1, Time: v.Time})
+		}
+		sort.Slice(archives, func(i, j int) bool {
+			return archives[i].Name < archives[j].Name
+		})
+		return archives
+	}
+	var found []types.Asset
+	for _, a := range assets {
+		if strings.HasPrefix(a.Name, v.Name+".") {
+			found = append(found, a)
+		}
+	}
+	return found
+}
+
+// copyAsset streams the asset name from src to dst, returning its size
+func copyAsset(src, dst types.Provider, name string) (int64, error) {
+	r, w := io.Pipe()
+	var getErr error
+	done := make(chan struct{})
+	cw := &fileio.CountingWriter{W: w}
+	go func() {
+		getErr = src.GetAsset(name, cw)
+		w.CloseWithError(getErr)
+		close(done)
+	}()
+	pushErr := dst.PushAsset(name, r)
+	// Unblock the download if the upload stopped reading before the end
+	r.CloseWithError(errSyncAborted)
+	<-done
+	if getErr != nil && !errors.Is(getErr, errSyncAborted) {
+		return 0, getErr
+	}
+	if pushErr != nil {
+		return 0, pushErr
+	}
+	return cw.N, nil
+}
+
+var errSyncAborted = errors.New("sync aborted")
@@ -0,0 +1,197 @@
+package dsdl
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/davidmanzanares/dsd/provider/memory"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// testServices counts the services returned by testService
+var testServices int
+
+// testService returns a mem:// service named after the test, unique to this run
+// The mem:// services outlive the test runs, like with go test -count
+func testService(t *testing.T, name string) string {
+	testServices++
+	return fmt.Sprintf("mem://%s-%s-%d", t.Name(), name, testServices)
+}
+
+func syncTestProvider(t *testing.T, service string) *memory.Memory {
+	p, err := memory.Create(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p.(*memory.Memory)
+}
+
+func TestSync(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	fromService, toService := testService(t, "from"), testService(t, "to")
+	target := Target{Name: "test", Service: fromService, Patterns: testPatterns}
+	v1, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Sync(fromService, toService, SyncConf{Version: v1.Name})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Versions) != 1 || result.Versions[0].Name != v1.Name || len(result.Assets) != 1 || result.Bytes == 0 {
+		t.Fatal(result)
+	}
+	to := syncTestProvider(t, toService)
+	if _, err := to.GetCurrentVersion(); !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("The current version was set", err)
+	}
+
+	result, err = Sync(fromService, toService, SyncConf{All: true, SetCurrent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The archive of v1 was already copied
+	if len(result.Versions) != 2 || len(result.Assets) != 1 || result.Assets[0].Name != v2.Name+".tar.gz" {
+		t.Fatal(result)
+	}
+	versions, err := to.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Name != v2.Name || !versions[0].Time.Equal(v2.Time) || versions[1].Name != v1.Name {
+		t.Fatal(versions)
+	}
+
+	var src, dst bytes.Buffer
+	syncTestProvider(t, fromService).GetAsset(v2.Name+".tar.gz", &src)
+	to.GetAsset(v2.Name+".tar.gz", &dst)
+	if src.Len() == 0 || !bytes.Equal(src.Bytes(), dst.Bytes()) {
+		t.Fatal("The copied archive doesn't match")
+	}
+}
+
+func TestSyncExtraAssets(t *testing.T) {
+	service, to := testService(t, "from"), testService(t, "to")
+	from := syncTestProvider(t, service)
+	from.PushAsset("a.tar.gz", strings.NewReader("archive"))
+	from.PushAsset("a.sig", strings.NewReader("signature"))
+	from.PushAsset("ab.tar.gz", strings.NewReader("other version"))
+	from.PushVersion(types.Version{Name: "a"})
+
+	result, err := Sync(service, to, SyncConf{SetCurrent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(result.Assets) != 2 || result.Assets[0].Name != "a.sig" || result.Assets[1].Name != "a.tar.gz" {
+		t.Fatal(result)
+	}
+	v, err := syncTestProvider(t, to).GetCurrentVersion()
+	if err != nil || v.Name != "a" {
+		t.Fatal(v, err)
+	}
+}
+
+func TestSyncErrors(t *testing.T) {
+	service, to := testService(t, "from"), testService(t, "to")
+	_, err := Sync(testService(t, "empty"), to, SyncConf{})
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected not found error", err)
+	}
+	from := syncTestProvider(t, service)
+	from.PushVersion(types.Version{Name: "a"})
+	_, err = Sync(service, to, SyncConf{Version: "b"})
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected not found error", err)
+	}
+	_, err = Sync(service, to, SyncConf{})
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected missing assets error", err)
+	}
+	_, err = Sync(service, "invalid://sync", SyncConf{})
+	if !errors.Is(err, types.ErrUnknownScheme) {
+		t.Fatal("Expected unknown scheme error", err)
+	}
+}
+
+func TestSyncWithoutHistory(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsd-sync-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	service := "file://" + dir
+	p, err := getProviderFromService(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.PushAsset("a.tar.gz", strings.NewReader("a"))
+	p.PushVersion(types.Version{Name: "a"})
+
+	to := testService(t, "to")
+	for _, conf := range []SyncConf{{All: true}, {Version: "b"}} {
+		_, err = Sync(service, to, conf)
+		if err == nil || !strings.Contains(err.Error(), "can't list its versions") {
+			t.Fatal("Expected unsupported history error", conf, err)
+		}
+	}
+	result, err := Sync(service, to, SyncConf{Version: "a"})
+	if err != nil || len(result.Versions) != 1 || result.Versions[0].Name != "a" {
+		t.Fatal(result, err)
+	}
+}
+
+func TestVersionAssetsUnlisted(t *testing.T) {
+	assets := versionAssets(types.Version{Name: "a"}, nil)
+	if len(assets) != 1 || assets[0].Name != "a.tar.gz" {
+		t.Fatal(assets)
+	}
+	assets = versionAssets(types.Version{Name: "a", Platforms: map[string]types.Artifact{
+		"windows": {Asset: "a.windows.tar.gz"}, "linux/amd64": {Asset: "a.linux-amd64.tar.gz"}}}, nil)
+	if len(assets) != 2 || assets[0].Name != "a.linux-amd64.tar.gz" || assets[1].Name != "a.windows.tar.gz" {
+		t.Fatal(assets)
+	}
+}
+
+func TestSyncBlobs(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	from, to := testService(t, "from"), testService(t, "to")
+	target := Target{Name: "test", Service: from, Patterns: testPatterns, Blobs: true, Codec: "zstd"}
+	_, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := Deploy(target, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	result, err := Sync(from, to, SyncConf{All: true, SetCurrent: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Both versions share their blobs, which are only copied once
+	if len(result.Versions) != 2 || len(result.Assets) != 7+2 {
+		t.Fatal(result)
+	}
+	assets, err := syncTestProvider(t, to).ListAssets()
+	if err != nil || len(assets) != len(result.Assets) {
+		t.Fatal(assets, err)
+	}
+	err = Download(to, Limits{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkFiles(v2, t)
+}
@@ -0,0 +1,20 @@
+package dsdl
+
+import "github.com/davidmanzanares/dsd/types"
+
+// Versions returns the versions deployed on service, newest first
+// Services without history only return their current version
+func Versions(service string) ([]types.Version, error) {
+	p, err := getProviderFromService(service)
+	if err != nil {
+		return nil, err
+	}
+	if h, ok := p.(types.VersionHistory); ok {
+		return h.History()
+	}
+	v, err := p.GetCurrentVersion()
+	if err != nil {
+		return nil, err
+	}
+	return []types.Version{v}, nil
+}
@@ -0,0 +1,65 @@
+package dsdl
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/go-git/go-git/v5"
+)
+
+func TestVersionsHistory(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	dir, err := ioutil.TempDir("", "dsd-versions-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	_, err = git.PlainInit(dir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	service := "git+file://" + filepath.ToSlash(dir)
+	v1, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := Versions(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 2 || versions[0].Name != v2.Name || versions[1].Name != v1.Name {
+		t.Fatal(versions)
+	}
+}
+
+func TestVersionsCurrent(t *testing.T) {
+	createTestAssets()
+	defer deleteTestAssets()
+	dir, err := ioutil.TempDir("", "dsd-versions-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	service := "file://" + filepath.ToSlash(dir)
+	Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
+	v, err := Deploy(Target{Name: "test", Service: service, Patterns: testPatterns}, DeployConf{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	versions, err := Versions(service)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(versions) != 1 || versions[0].Name != v.Name {
+		t.Fatal(versions)
+	}
+}
@@ -1,8 +1,35 @@
 module github.com/davidmanzanares/dsd
 
-go 1.13
+go 1.22
 
 require (
 	github.com/aws/aws-sdk-go v1.29.16
+	github.com/bmatcuk/doublestar/v2 v2.0.4
+	github.com/go-git/go-git/v5 v5.4.2
+	github.com/klauspost/compress v1.18.0
+	github.com/pkg/sftp v1.13.6
 	github.com/spf13/cobra v0.0.6
+	golang.org/x/crypto v0.1.0
+)
+
+require (
+	github.com/Microsoft/go-winio v0.4.16 // indirect
+	github.com/ProtonMail/go-crypto v0.0.0-20210428141323-04723f9f07d7 // indirect
+	github.com/acomagu/bufpipe v1.0.3 // indirect
+	github.com/emirpasic/gods v1.12.0 // indirect
+	github.com/go-git/gcfg v1.5.0 // indirect
+	github.com/go-git/go-billy/v5 v5.3.1 // indirect
+	github.com/imdario/mergo v0.3.12 // indirect
+	github.com/inconshreveable/mousetrap v1.0.0 // indirect
+	github.com/jbenet/go-context v0.0.0-20150711004518-d14ea06fba99 // indirect
+	github.com/jmespath/go-jmespath v0.0.0-20180206201540-c2b33e8439af // indirect
+	github.com/kevinburke/ssh_config v0.0.0-20201106050909-4977a11b4351 // indirect
+	github.com/kr/fs v0.1.0 // indirect
+	github.com/mitchellh/go-homedir v1.1.0 // indirect
+	github.com/sergi/go-diff v1.1.0 // indirect
+	github.com/spf13/pflag v1.0.3 // indirect
+	github.com/xanzy/ssh-agent v0.3.0 // indirect
+	golang.org/x/net v0.1.0 // indirect
+	golang.org/x/sys v0.1.0 // indirect
+	gopkg.in/warnings.v0 v0.1.2 // indirect
 )
@@ -0,0 +1,91 @@
+// Package fileio has the I/O helpers shared by the providers and dsdl
+package fileio
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// CountingWriter counts the bytes written to W
+type CountingWriter struct {
+	N int64
+	W io.Writer
+}
+
+func (c *CountingWriter) Write(p []byte) (int, error) {
+	n, err := c.W.Write(p)
+	c.N += int64(n)
+	return n, err
+}
+
+// TransientReader marks the errors reading R as transient, like response bodies whose connection was lost
+type TransientReader struct {
+	R io.Reader
+}
+
+func (t TransientReader) Read(p []byte) (int, error) {
+	n, err := t.R.Read(p)
+	if err != nil && err != io.EOF {
+		err = types.WrapError(types.ErrTransient, err)
+	}
+	return n, err
+}
+
+// CheckAssetName rejects the asset names which aren't clean slash separated relative paths
+func CheckAssetName(name string) error {
+	clean := path.Clean("/" + name)
+	if name == "" || clean != "/"+name || strings.Contains(name, `\`) {
+		return fmt.Errorf("Invalid asset name: %s", name)
+	}
+	return nil
+}
+
+// TmpPrefix prefixes the temporary files used to write files atomically, listings must skip them
+const TmpPrefix = ".tmp-"
+
+// FS is a file system where WriteAtomic writes
+type FS interface {
+	MkdirAll(dir string) error
+	// Create creates a new file, closing it must flush it to the storage
+	Create(name string) (io.WriteCloser, error)
+	Rename(from, to string) error
+	Remove(name string) error
+}
+
+// WriteAtomic writes reader's content to a temporary file, renaming it to filename after a full success
+// filename can use slashes or the OS separators
+func WriteAtomic(fs FS, filename string, reader io.Reader) error {
+	i := strings.LastIndexAny(filename, "/"+string(os.PathSeparator))
+	if i >= 0 {
+		err := fs.MkdirAll(filename[:i])
+		if err != nil {
+			return err
+		}
+	}
+	suffix := make([]byte, 8)
+	rand.Read(suffix)
+	tmp := filename[:i+1] + TmpPrefix + filename[i+1:] + "-" + hex.EncodeToString(suffix)
+	f, err := fs.Create(tmp)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(f, reader)
+	closeErr := f.Close()
+	if err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = fs.Rename(tmp, filename)
+	}
+	if err != nil {
+		fs.Remove(tmp)
+	}
+	return err
+}
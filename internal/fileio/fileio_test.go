@@ -0,0 +1,81 @@
+package fileio
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+)
+
+// memFS is an in-memory FS
+type memFS struct {
+	files map[string]*bytes.Buffer
+}
+
+func (m memFS) MkdirAll(dir string) error {
+	return nil
+}
+
+func (m memFS) Create(name string) (io.WriteCloser, error) {
+	m.files[name] = &bytes.Buffer{}
+	return nopCloser{m.files[name]}, nil
+}
+
+func (m memFS) Rename(from, to string) error {
+	m.files[to] = m.files[from]
+	delete(m.files, from)
+	return nil
+}
+
+func (m memFS) Remove(name string) error {
+	delete(m.files, name)
+	return nil
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
+
+type failingReader struct{}
+
+func (failingReader) Read(p []byte) (int, error) {
+	return 0, errors.New("read error")
+}
+
+func TestWriteAtomic(t *testing.T) {
+	fs := memFS{files: map[string]*bytes.Buffer{}}
+	err := WriteAtomic(fs, "assets/a.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(fs.files) != 1 || fs.files["assets/a.tar.gz"].String() != "holamundo" {
+		t.Fatal(fs.files)
+	}
+
+	// Failed writes leave neither the file nor its temporary file
+	err = WriteAtomic(fs, "assets/b.tar.gz", io.MultiReader(strings.NewReader("hola"), failingReader{}))
+	if err == nil {
+		t.Fatal("Expected read error")
+	}
+	if len(fs.files) != 1 {
+		t.Fatal(fs.files)
+	}
+}
+
+func TestCheckAssetName(t *testing.T) {
+	for _, name := range []string{"a.tar.gz", "blobs/a", "a/b/c"} {
+		if err := CheckAssetName(name); err != nil {
+			t.Error(err)
+		}
+	}
+	for _, name := range []string{"", "../VERSION", "a/../../b", "/abs", `a\b`, "a//b", "a/"} {
+		if CheckAssetName(name) == nil {
+			t.Error("Expected invalid name error:", name)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+// Package bundle stores a single version and its assets in one file, to move deployments to machines without network access
+// Bundles are uncompressed tar files containing the VERSION file and the assets/ folder
+package bundle
+
+import (
+	"archive/tar"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// ErrReadOnly is returned when pushing to or deleting from a bundle
+var ErrReadOnly = errors.New("Bundle service is read-only")
+
+const versionEntry = "VERSION"
+const assetsPrefix = "assets/"
+
+// Bundle is a read-only provider reading a bundle file
+type Bundle struct {
+	filename string
+	version  *types.Version
+	assets   []types.Asset
+}
+
+// Create returns the Bundle provider for service, like bundle:/path/to/file.dsd
+func Create(service string) (types.Provider, error) {
+	if !strings.HasPrefix(service, "bundle:") {
+		return nil, errors.New("Bundle service must begin with bundle:")
+	}
+	return Open(strings.TrimPrefix(service, "bundle:"))
+}
+
+// Open returns a Bundle provider reading filename, the file is indexed once and read again on every download
+func Open(filename string) (*Bundle, error) {
+	f, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return nil, fmt.Errorf("Bundle %s: %w", filename, types.ErrNotFound)
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	b := &Bundle{filename: filename}
+	r := tar.NewReader(f)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("Invalid bundle %s: %w", filename, err)
+		}
+		switch {
+		case h.Name == versionEntry:
+			buffer, err := ioutil.ReadAll(r)
+			if err != nil {
+				return nil, err
+			}
+			v, err := types.DeserializeVersion(buffer)
+			if err != nil {
+				return nil, fmt.Errorf("Invalid bundle %s VERSION: %w", filename, err)
+			}
+			b.version = &v
+		case strings.HasPrefix(h.Name, assetsPrefix) && h.Typeflag == tar.TypeReg:
+			b.assets = append(b.assets, types.Asset{Name: h.Name[len(assetsPrefix):], Size: h.Size, Time: h.ModTime})
+		}
+	}
+	return b, nil
+}
+
+func (b *Bundle) GetAsset(name string, writer io.Writer) error {
+	f, err := os.Open(b.filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := tar.NewReader(f)
+	for {
+		h, err := r.Next()
+		if err == io.EOF {
+			return fmt.Errorf("Bundle asset %s: %w", name, types.ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		if h.Name == assetsPrefix+name {
+			_, err = io.Copy(writer, r)
+			return err
+		}
+	}
+}
+
+func (b *Bundle) PushAsset(name string, reader io.Reader) error {
+	return ErrReadOnly
+}
+
+func (b *Bundle) GetCurrentVersion() (types.Version, error) {
+	if b.version == nil {
+		return types.Version{}, fmt.Errorf("Bundle %s has no version: %w", b.filename, types.ErrNotFound)
+	}
+	return *b.version, nil
+}
+
+func (b *Bundle) PushVersion(v types.Version) error {
+	return ErrReadOnly
+}
+
+// ListAssets lists the assets stored in the bundle
+func (b *Bundle) ListAssets() ([]types.Asset, error) {
+	return b.assets, nil
+}
+
+// DeleteAsset always fails, bundles are read-only
+func (b *Bundle) DeleteAsset(name string) error {
+	return ErrReadOnly
+}
+
+// Writer is a write-only provider writing a bundle, it only accepts one version
+// Pushed assets are spooled to temporary files because their sizes are needed beforehand
+type Writer struct {
+	mutex   sync.Mutex
+	w       *tar.Writer
+	version bool
+}
+
+// NewWriter returns a Writer writing the bundle to w, it must be closed to finish it
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: tar.NewWriter(w)}
+}
+
+func (w *Writer) GetAsset(name string, writer io.Writer) error {
+	return fmt.Errorf("Bundle writers are write-only, asset %s: %w", name, types.ErrNotFound)
+}
+
+func (w *Writer) PushAsset(name string, reader io.Reader) error {
+	clean := path.Clean("/" + name)
+	if name == "" || clean != "/"+name || strings.Contains(name, `\`) {
+		return fmt.Errorf("Invalid asset name: %s", name)
+	}
+	spool, err := ioutil.TempFile("", "dsd-bundle-")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(spool.Name())
+	defer spool.Close()
+	size, err := io.Copy(spool, reader)
+	if err != nil {
+		return err
+	}
+	_, err = spool.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.writeEntry(assetsPrefix+name, size, spool)
+}
+
+func (w *Writer) GetCurrentVersion() (types.Version, error) {
+	return types.Version{}, fmt.Errorf("Bundle writers are write-only: %w", types.ErrNotFound)
+}
+
+func (w *Writer) PushVersion(v types.Version) error {
+	buff, err := v.Serialize()
+	if err != nil {
+		return err
+	}
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if w.version {
+		return errors.New("Bundles can only contain one version")
+	}
+	w.version = true
+	return w.writeEntry(versionEntry, int64(len(buff)), bytes.NewReader(buff))
+}
+
+// Close finishes the bundle, without closing the underlying writer
+func (w *Writer) Close() error {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	if !w.version {
+		return errors.New("Bundle without version")
+	}
+	return w.w.Close()
+}
+
+func (w *Writer) writeEntry(name string, size int64, reader io.Reader) error {
+	err := w.w.WriteHeader(&tar.Header{Name: name, Size: size, Mode: 0660, ModTime: time.Now(), Typeflag: tar.TypeReg})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w.w, reader)
+	return err
+}
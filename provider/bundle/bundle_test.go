@@ -0,0 +1,115 @@
+package bundle
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+func writeBundle(t *testing.T, v *types.Version, assets map[string]string) string {
+	f, err := ioutil.TempFile("", "dsd-bundle-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	w := NewWriter(f)
+	for name, content := range assets {
+		err = w.PushAsset(name, strings.NewReader(content))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v != nil {
+		err = w.PushVersion(*v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = w.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return f.Name()
+}
+
+func TestRoundTrip(t *testing.T) {
+	v := types.Version{Name: "a", Time: time.Now().Truncate(time.Second)}
+	filename := writeBundle(t, &v, map[string]string{"a.tar.gz": "archive", "a.sig": "signature"})
+	defer os.Remove(filename)
+
+	p, err := Create("bundle:" + filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := p.GetCurrentVersion()
+	if err != nil || v2.Name != v.Name || !v2.Time.Equal(v.Time) {
+		t.Fatal(v2, err)
+	}
+	var buff bytes.Buffer
+	err = p.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "archive" {
+		t.Fatal(buff.String(), err)
+	}
+	err = p.GetAsset("b.tar.gz", &buff)
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected not found error", err)
+	}
+	assets, err := p.(types.AssetManager).ListAssets()
+	if err != nil || len(assets) != 2 {
+		t.Fatal(assets, err)
+	}
+
+	if p.PushAsset("b.tar.gz", strings.NewReader("b")) != ErrReadOnly ||
+		p.PushVersion(v) != ErrReadOnly ||
+		p.(types.AssetManager).DeleteAsset("a.tar.gz") != ErrReadOnly {
+		t.Fatal("Bundles must be read-only")
+	}
+}
+
+func TestWriterErrors(t *testing.T) {
+	w := NewWriter(ioutil.Discard)
+	if w.PushAsset("../a.tar.gz", strings.NewReader("a")) == nil {
+		t.Fatal("Expected invalid name error")
+	}
+	if w.Close() == nil {
+		t.Fatal("Bundles need a version")
+	}
+	err := w.PushVersion(types.Version{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.PushVersion(types.Version{Name: "b"}) == nil {
+		t.Fatal("Bundles can't have two versions")
+	}
+}
+
+func TestOpenErrors(t *testing.T) {
+	_, err := Open(filepath.Join(os.TempDir(), "dsd-missing-bundle"))
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected not found error", err)
+	}
+
+	filename := writeBundle(t, nil, map[string]string{"a.tar.gz": "archive"})
+	defer os.Remove(filename)
+	b, err := Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = b.GetCurrentVersion()
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected not found error", err)
+	}
+
+	ioutil.WriteFile(filename, []byte("not a bundle"), 0660)
+	_, err = Open(filename)
+	if err == nil {
+		t.Fatal("Expected invalid bundle error")
+	}
+}
@@ -0,0 +1,168 @@
+package file
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/davidmanzanares/dsd/internal/fileio"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// File stores the VERSION/assets layout in a local (or mounted) folder
+type File struct {
+	path string
+}
+
+var errInvalidURL error = errors.New("File service must begin with file://")
+
+// Create returns a File provider for service, the folder is created on the first push
+func Create(service string) (types.Provider, error) {
+	if !strings.HasPrefix(service, "file://") {
+		return nil, errInvalidURL
+	}
+	return &File{path: filepath.FromSlash(service[len("file://"):])}, nil
+}
+
+func (f *File) GetAsset(name string, writer io.Writer) error {
+	filename, err := f.assetPath(name)
+	if err != nil {
+		return err
+	}
+	file, err := os.Open(filename)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("File asset %s: %w", name, types.ErrNotFound)
+	}
+	if err != nil {
+		return wrapError(err)
+	}
+	defer file.Close()
+	_, err = io.Copy(writer, file)
+	return err
+}
+
+func (f *File) PushAsset(name string, reader io.Reader) error {
+	filename, err := f.assetPath(name)
+	if err != nil {
+		return err
+	}
+	return wrapError(fileio.WriteAtomic(osFS{}, filename, reader))
+}
+
+func (f *File) GetCurrentVersion() (types.Version, error) {
+	buffer, err := ioutil.ReadFile(filepath.Join(f.path, "VERSION"))
+	if os.IsNotExist(err) {
+		return types.Version{}, fmt.Errorf("File error getting version: %w", types.ErrNotFound)
+	}
+	if err != nil {
+		return types.Version{}, wrapError(err)
+	}
+	v, err := types.DeserializeVersion(buffer)
+	if err != nil {
+		return v, fmt.Errorf("Error %s\nVERSION file contains: \"%s\"\n", err.Error(), string(buffer))
+	}
+	return v, nil
+}
+
+func (f *File) PushVersion(v types.Version) error {
+	buff, err := v.Serialize()
+	if err != nil {
+		return err
+	}
+	return wrapError(fileio.WriteAtomic(osFS{}, filepath.Join(f.path, "VERSION"), bytes.NewReader(buff)))
+}
+
+// ListAssets lists every asset stored under the service's assets folder
+func (f *File) ListAssets() ([]types.Asset, error) {
+	folder := filepath.Join(f.path, "assets")
+	var assets []types.Asset
+	err := filepath.Walk(folder, func(filename string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if os.IsNotExist(err) && filename == folder {
+				return filepath.SkipDir
+			}
+			return err
+		}
+		if fi.IsDir() || strings.HasPrefix(fi.Name(), fileio.TmpPrefix) {
+			return nil
+		}
+		name, err := filepath.Rel(folder, filename)
+		if err != nil {
+			return err
+		}
+		assets = append(assets, types.Asset{Name: filepath.ToSlash(name), Size: fi.Size(), Time: fi.ModTime()})
+		return nil
+	})
+	return assets, err
+}
+
+// DeleteAsset removes the asset name from the service
+func (f *File) DeleteAsset(name string) error {
+	filename, err := f.assetPath(name)
+	if err != nil {
+		return err
+	}
+	err = os.Remove(filename)
+	if os.IsNotExist(err) {
+		return fmt.Errorf("File asset %s: %w", name, types.ErrNotFound)
+	}
+	return wrapError(err)
+}
+
+// wrapError marks permission errors as types.ErrUnauthorized
+func wrapError(err error) error {
+	if errors.Is(err, os.ErrPermission) {
+		return types.WrapError(types.ErrUnauthorized, err)
+	}
+	return err
+}
+
+// assetPath returns the path of the asset name, rejecting names outside the assets folder
+func (f *File) assetPath(name string) (string, error) {
+	err := fileio.CheckAssetName(name)
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(f.path, "assets", filepath.FromSlash(name)), nil
+}
+
+// osFS is the local file system, its files are synced to disk when closed
+type osFS struct{}
+
+func (osFS) MkdirAll(dir string) error {
+	return os.MkdirAll(dir, 0755)
+}
+
+func (osFS) Create(name string) (io.WriteCloser, error) {
+	f, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	return syncedFile{f}, nil
+}
+
+func (osFS) Rename(from, to string) error {
+	return os.Rename(from, to)
+}
+
+func (osFS) Remove(name string) error {
+	return os.Remove(name)
+}
+
+type syncedFile struct {
+	*os.File
+}
+
+func (f syncedFile) Close() error {
+	err := f.Sync()
+	closeErr := f.File.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
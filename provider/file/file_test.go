@@ -0,0 +1,156 @@
+package file
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/provider/providertest"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+func testFile(t *testing.T) (types.Provider, func()) {
+	dir, err := ioutil.TempDir("", "dsd-file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := Create("file://" + dir + "/service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return f, func() { os.RemoveAll(dir) }
+}
+
+func TestAsset(t *testing.T) {
+	f, clean := testFile(t)
+	defer clean()
+
+	err := f.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buff bytes.Buffer
+	err = f.GetAsset("a.tar.gz", &buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buff.String() != "holamundo" {
+		t.Fatal(buff.String())
+	}
+	err = f.GetAsset("missing", &buff)
+	if err == nil {
+		t.Fatal("Expected not found error")
+	}
+}
+
+func TestAssetPermissions(t *testing.T) {
+	dir, err := ioutil.TempDir("", "dsd-file-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	f, err := Create("file://" + dir + "/service")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.PushAsset("a/b.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The assets are readable by others like any other file, unless the umask narrows them
+	err = os.Mkdir(dir+"/reference", 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(dir+"/reference/file", nil, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for asset, reference := range map[string]string{"assets/a": "reference", "assets/a/b.tar.gz": "reference/file"} {
+		fi, err := os.Stat(dir + "/service/" + asset)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, err := os.Stat(dir + "/" + reference)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fi.Mode().Perm() != ref.Mode().Perm() {
+			t.Error(asset, fi.Mode(), ref.Mode())
+		}
+	}
+}
+
+func TestInvalidAssetNames(t *testing.T) {
+	f, clean := testFile(t)
+	defer clean()
+
+	for _, name := range []string{"", "../VERSION", "a/../../b", "/abs", `a\b`, "a//b"} {
+		err := f.PushAsset(name, strings.NewReader("holamundo"))
+		if err == nil {
+			t.Error("Expected invalid name error:", name)
+		}
+	}
+}
+
+func TestVersion(t *testing.T) {
+	f, clean := testFile(t)
+	defer clean()
+
+	_, err := f.GetCurrentVersion()
+	if err == nil {
+		t.Fatal("Expected error, nothing deployed")
+	}
+	v := types.Version{Name: "wadus", Time: time.Now().Truncate(time.Second)}
+	err = f.PushVersion(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := f.GetCurrentVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.Name != v.Name || !v2.Time.Equal(v.Time) {
+		t.Fatal(v2)
+	}
+}
+
+func TestListDeleteAssets(t *testing.T) {
+	f, clean := testFile(t)
+	defer clean()
+	m := f.(types.AssetManager)
+
+	assets, err := m.ListAssets()
+	if err != nil || len(assets) != 0 {
+		t.Fatal(assets, err)
+	}
+	f.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	f.PushAsset("folder/b", strings.NewReader("hola"))
+	assets, err = m.ListAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 2 || assets[0].Name != "a.tar.gz" || assets[0].Size != 9 || assets[1].Name != "folder/b" {
+		t.Fatal(assets)
+	}
+	err = m.DeleteAsset("a.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assets, err = m.ListAssets()
+	if err != nil || len(assets) != 1 {
+		t.Fatal(assets, err)
+	}
+}
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) types.Provider {
+		f, clean := testFile(t)
+		t.Cleanup(clean)
+		return f
+	})
+}
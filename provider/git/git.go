@@ -0,0 +1,444 @@
+package git
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidmanzanares/dsd/types"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	gitssh "github.com/go-git/go-git/v5/plumbing/transport/ssh"
+)
+
+// Git stores the VERSION/assets layout as the tree of a branch in a bare git repository
+// Every push is a new commit, the history of the branch is the history of the service
+type Git struct {
+	repo   *git.Repository
+	branch plumbing.ReferenceName
+	// remote repositories are mirrored in a local cache, fetching before and pushing after every operation
+	remote bool
+	auth   transport.AuthMethod
+
+	mutex sync.Mutex
+}
+
+// Create returns a Git provider for service, like git+file:///srv/dsd.git or git+ssh://git@host/dsd.git
+// Options are set with query parameters:
+//
+//	branch: the branch storing the service, "dsd" by default
+//	key: private key file used by git+ssh:// services, the SSH agent is used by default
+//	known-hosts: known_hosts file used by git+ssh:// services, ~/.ssh/known_hosts by default
+func Create(service string) (types.Provider, error) {
+	u, err := url.Parse(service)
+	if err != nil {
+		return nil, err
+	}
+	options, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	u.RawQuery = ""
+	branch := "dsd"
+	var key, knownHosts string
+	for k, v := range options {
+		switch k {
+		case "branch":
+			branch = v[len(v)-1]
+		case "key":
+			key = v[len(v)-1]
+		case "known-hosts":
+			knownHosts = v[len(v)-1]
+		default:
+			return nil, fmt.Errorf("Unknown git option: %s", k)
+		}
+	}
+
+	switch u.Scheme {
+	case "git+file":
+		repo, err := git.PlainOpen(filepath.FromSlash(u.Path))
+		if err != nil {
+			return nil, fmt.Errorf("Error opening git repository %s: %s", u.Path, err.Error())
+		}
+		return &Git{repo: repo, branch: plumbing.NewBranchReferenceName(branch)}, nil
+	case "git+ssh":
+		auth, err := sshAuth(u.User.Username(), key, knownHosts)
+		if err != nil {
+			return nil, err
+		}
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return nil, err
+		}
+		u.Scheme = "ssh"
+		return open(u.String(), branch, auth, cache)
+	}
+	return nil, errors.New("Git service must begin with git+file:// or git+ssh://")
+}
+
+func sshAuth(user, key, knownHosts string) (transport.AuthMethod, error) {
+	var auth transport.AuthMethod
+	var helper *gitssh.HostKeyCallbackHelper
+	if key != "" {
+		keys, err := gitssh.NewPublicKeysFromFile(user, key, "")
+		if err != nil {
+			return nil, err
+		}
+		auth, helper = keys, &keys.HostKeyCallbackHelper
+	} else {
+		agent, err := gitssh.NewSSHAgentAuth(user)
+		if err != nil {
+			return nil, err
+		}
+		auth, helper = agent, &agent.HostKeyCallbackHelper
+	}
+	if knownHosts != "" {
+		callback, err := gitssh.NewKnownHostsCallback(knownHosts)
+		if err != nil {
+			return nil, err
+		}
+		helper.HostKeyCallback = callback
+	}
+	return auth, nil
+}
+
+// open returns a Git provider for the remote repository at remoteURL, mirrored in a bare repository inside cache
+func open(remoteURL string, branch string, auth transport.AuthMethod, cache string) (*Git, error) {
+	hash := sha256.Sum256([]byte(remoteURL))
+	dir := filepath.Join(cache, "dsd", "git", hex.EncodeToString(hash[:8]))
+	repo, err := git.PlainOpen(dir)
+	if err == git.ErrRepositoryNotExists {
+		repo, err = git.PlainInit(dir, true)
+		if err == nil {
+			_, err = repo.CreateRemote(&config.RemoteConfig{Name: "origin", URLs: []string{remoteURL}})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &Git{repo: repo, branch: plumbing.NewBranchReferenceName(branch), remote: true, auth: auth}, nil
+}
+
+func (g *Git) GetAsset(name string, writer io.Writer) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	tip, err := g.tip()
+	if err != nil {
+		return err
+	}
+	if tip == nil {
+		return fmt.Errorf("Git asset %s: %w", name, types.ErrNotFound)
+	}
+	f, err := tip.File("assets/" + name)
+	if err == object.ErrFileNotFound {
+		return fmt.Errorf("Git asset %s: %w", name, types.ErrNotFound)
+	}
+	if err != nil {
+		return fmt.Errorf("Git asset %s: %s", name, err.Error())
+	}
+	r, err := f.Reader()
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	_, err = io.Copy(writer, r)
+	return err
+}
+
+func (g *Git) PushAsset(name string, reader io.Reader) error {
+	if name == "" || strings.Contains(name, `\`) || path.Clean("/"+name) != "/"+name {
+		return fmt.Errorf("Invalid asset name: %s", name)
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	blob, err := g.storeBlob(reader)
+	if err != nil {
+		return err
+	}
+	return g.commit("assets/"+name, blob, "Add asset "+name, time.Now())
+}
+
+func (g *Git) GetCurrentVersion() (types.Version, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	tip, err := g.tip()
+	if err != nil {
+		return types.Version{}, err
+	}
+	if tip == nil {
+		return types.Version{}, fmt.Errorf("Git error getting version: branch %s %w", g.branch.Short(), types.ErrNotFound)
+	}
+	return versionAt(tip)
+}
+
+// PushVersion commits the VERSION file, the commit time is the version time
+func (g *Git) PushVersion(v types.Version) error {
+	buff, err := v.Serialize()
+	if err != nil {
+		return err
+	}
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	blob, err := g.storeBlob(bytes.NewReader(buff))
+	if err != nil {
+		return err
+	}
+	message := "Deploy " + v.Name
+	if v.Message != "" {
+		message += "\n\n" + v.Message
+	}
+	return g.commit("VERSION", blob, message, v.Time)
+}
+
+// History returns the versions pushed to the service, newest first, from the commits changing the VERSION file
+func (g *Git) History() ([]types.Version, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	c, err := g.tip()
+	if err != nil || c == nil {
+		return nil, err
+	}
+	var versions []types.Version
+	for {
+		var parent *object.Commit
+		if len(c.ParentHashes) > 0 {
+			parent, err = c.Parent(0)
+			if err != nil {
+				return versions, err
+			}
+		}
+		entry := versionEntry(c)
+		if entry != nil && (parent == nil || versionEntry(parent) == nil || versionEntry(parent).Hash != entry.Hash) {
+			v, err := versionAt(c)
+			if err != nil {
+				return versions, err
+			}
+			versions = append(versions, v)
+		}
+		if parent == nil {
+			return versions, nil
+		}
+		c = parent
+	}
+}
+
+// tip fetches the branch if the repository is remote, returning its last commit, nil if the branch doesn't exist
+func (g *Git) tip() (*object.Commit, error) {
+	if g.remote {
+		spec := config.RefSpec("+" + g.branch + ":" + g.branch)
+		err := g.repo.Fetch(&git.FetchOptions{RemoteName: "origin", RefSpecs: []config.RefSpec{spec}, Auth: g.auth})
+		if err != nil && err != git.NoErrAlreadyUpToDate && err != transport.ErrEmptyRemoteRepository &&
+			!errors.Is(err, git.NoMatchingRefSpecError{}) {
+			return nil, remoteError(err)
+		}
+	}
+	ref, err := g.repo.Reference(g.branch, true)
+	if err == plumbing.ErrReferenceNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return g.repo.CommitObject(ref.Hash())
+}
+
+// commit creates a new commit on the branch, setting the file filename to blob
+func (g *Git) commit(filename string, blob plumbing.Hash, message string, when time.Time) error {
+	parent, err := g.tip()
+	if err != nil {
+		return err
+	}
+	var tree plumbing.Hash
+	if parent != nil {
+		tree = parent.TreeHash
+	}
+	tree, err = g.updateTree(tree, strings.Split(filename, "/"), blob)
+	if err != nil {
+		return err
+	}
+
+	signature := object.Signature{Name: "dsd", Email: "dsd@localhost", When: when}
+	if user := os.Getenv("USER"); user != "" {
+		signature.Name = user
+	}
+	c := &object.Commit{Author: signature, Committer: signature, Message: message, TreeHash: tree}
+	var old *plumbing.Reference
+	if parent != nil {
+		c.ParentHashes = []plumbing.Hash{parent.Hash}
+		old = plumbing.NewHashReference(g.branch, parent.Hash)
+	}
+	obj := g.repo.Storer.NewEncodedObject()
+	err = c.Encode(obj)
+	if err != nil {
+		return err
+	}
+	hash, err := g.repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+	err = g.repo.Storer.CheckAndSetReference(plumbing.NewHashReference(g.branch, hash), old)
+	if err != nil {
+		return err
+	}
+	if g.remote {
+		spec := config.RefSpec(g.branch + ":" + g.branch)
+		err = g.repo.Push(&git.PushOptions{RemoteName: "origin", RefSpecs: []config.RefSpec{spec}, Auth: g.auth})
+		return remoteError(err)
+	}
+	return nil
+}
+
+// remoteError marks the errors of fetches and pushes with the matching types error
+// Rejected pushes are transient, retrying fetches the commits pushed by others first
+func remoteError(err error) error {
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, transport.ErrAuthenticationRequired) || errors.Is(err, transport.ErrAuthorizationFailed):
+		return types.WrapError(types.ErrUnauthorized, err)
+	case errors.Is(err, git.ErrNonFastForwardUpdate) || errors.As(err, &netErr):
+		return types.WrapError(types.ErrTransient, err)
+	}
+	return err
+}
+
+// updateTree stores a copy of the tree with the file at parts set to blob, returning its hash
+func (g *Git) updateTree(tree plumbing.Hash, parts []string, blob plumbing.Hash) (plumbing.Hash, error) {
+	var entries []object.TreeEntry
+	if !tree.IsZero() {
+		t, err := g.repo.TreeObject(tree)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entries = append(entries, t.Entries...)
+	}
+
+	entry := object.TreeEntry{Name: parts[0], Mode: filemode.Regular, Hash: blob}
+	if len(parts) > 1 {
+		var subtree plumbing.Hash
+		for _, e := range entries {
+			if e.Name == parts[0] && e.Mode == filemode.Dir {
+				subtree = e.Hash
+			}
+		}
+		hash, err := g.updateTree(subtree, parts[1:], blob)
+		if err != nil {
+			return plumbing.ZeroHash, err
+		}
+		entry = object.TreeEntry{Name: parts[0], Mode: filemode.Dir, Hash: hash}
+	}
+	replaced := false
+	for i := range entries {
+		if entries[i].Name == entry.Name {
+			entries[i] = entry
+			replaced = true
+		}
+	}
+	if !replaced {
+		entries = append(entries, entry)
+	}
+	// Git sorts tree entries by name, comparing folders as if they ended with a slash
+	sortName := func(e object.TreeEntry) string {
+		if e.Mode == filemode.Dir {
+			return e.Name + "/"
+		}
+		return e.Name
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		return sortName(entries[i]) < sortName(entries[j])
+	})
+
+	obj := g.repo.Storer.NewEncodedObject()
+	err := (&object.Tree{Entries: entries}).Encode(obj)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return g.repo.Storer.SetEncodedObject(obj)
+}
+
+// storeBlob stores reader's content as a blob
+// The content is spooled to a temporary file to stream it into the repository without holding it in memory
+func (g *Git) storeBlob(reader io.Reader) (plumbing.Hash, error) {
+	f, err := ioutil.TempFile("", "dsd-git-blob")
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+	size, err := io.Copy(f, reader)
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	hasher := plumbing.NewHasher(plumbing.BlobObject, size)
+	_, err = io.Copy(hasher, io.NewSectionReader(f, 0, size))
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return g.repo.Storer.SetEncodedObject(&fileObject{f: f, size: size, hash: hasher.Sum()})
+}
+
+func versionEntry(c *object.Commit) *object.TreeEntry {
+	tree, err := c.Tree()
+	if err != nil {
+		return nil
+	}
+	entry, err := tree.FindEntry("VERSION")
+	if err != nil {
+		return nil
+	}
+	return entry
+}
+
+func versionAt(c *object.Commit) (types.Version, error) {
+	f, err := c.File("VERSION")
+	if err == object.ErrFileNotFound {
+		return types.Version{}, fmt.Errorf("Git error getting version: %w", types.ErrNotFound)
+	}
+	if err != nil {
+		return types.Version{}, fmt.Errorf("Git error getting version: %s", err.Error())
+	}
+	content, err := f.Contents()
+	if err != nil {
+		return types.Version{}, err
+	}
+	v, err := types.DeserializeVersion([]byte(content))
+	if err != nil {
+		return v, fmt.Errorf("Error %s\nVERSION file contains: \"%s\"\n", err.Error(), content)
+	}
+	return v, nil
+}
+
+// fileObject is a blob object backed by a file
+type fileObject struct {
+	f    *os.File
+	size int64
+	hash plumbing.Hash
+}
+
+func (o *fileObject) Hash() plumbing.Hash             { return o.hash }
+func (o *fileObject) Type() plumbing.ObjectType       { return plumbing.BlobObject }
+func (o *fileObject) SetType(plumbing.ObjectType)     {}
+func (o *fileObject) Size() int64                     { return o.size }
+func (o *fileObject) SetSize(int64)                   {}
+func (o *fileObject) Writer() (io.WriteCloser, error) { return nil, errors.New("Read-only object") }
+func (o *fileObject) Reader() (io.ReadCloser, error) {
+	return ioutil.NopCloser(io.NewSectionReader(o.f, 0, o.size)), nil
+}
@@ -0,0 +1,189 @@
+package git
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/provider/providertest"
+	"github.com/davidmanzanares/dsd/types"
+	"github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+func testRepository(t *testing.T) (string, func()) {
+	dir, err := ioutil.TempDir("", "dsd-git-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	repo := filepath.Join(dir, "repo.git")
+	_, err = git.PlainInit(repo, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return repo, func() { os.RemoveAll(dir) }
+}
+
+func testProvider(t *testing.T, p types.Provider) {
+	_, err := p.GetCurrentVersion()
+	if err == nil {
+		t.Fatal("Expected error, nothing deployed")
+	}
+	err = p.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.PushAsset("folder/b", strings.NewReader("hola"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.PushAsset("../b", strings.NewReader("hola"))
+	if err == nil {
+		t.Fatal("Expected invalid name error")
+	}
+	var buff bytes.Buffer
+	err = p.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "holamundo" {
+		t.Fatal(buff.String(), err)
+	}
+	buff.Reset()
+	err = p.GetAsset("folder/b", &buff)
+	if err != nil || buff.String() != "hola" {
+		t.Fatal(buff.String(), err)
+	}
+	err = p.GetAsset("missing", &buff)
+	if err == nil {
+		t.Fatal("Expected not found error")
+	}
+
+	start := time.Now().Truncate(time.Second)
+	for i, name := range []string{"a", "b", "c"} {
+		v := types.Version{Name: name, Time: start.Add(time.Duration(i) * time.Second)}
+		err = p.PushVersion(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Assets pushed between versions aren't part of the history
+		p.PushAsset(name+".tar.gz", strings.NewReader(name))
+		v2, err := p.GetCurrentVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v2.Name != v.Name || !v2.Time.Equal(v.Time) {
+			t.Fatal(v2)
+		}
+	}
+
+	history, err := p.(types.VersionHistory).History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Name != "c" || history[1].Name != "b" || history[2].Name != "a" {
+		t.Fatal(history)
+	}
+	if !history[2].Time.Equal(start) {
+		t.Fatal(history[2].Time)
+	}
+}
+
+func TestLocal(t *testing.T) {
+	repo, clean := testRepository(t)
+	defer clean()
+	p, err := Create("git+file://" + filepath.ToSlash(repo) + "?branch=deploys")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProvider(t, p)
+
+	// The versions are commits of the branch
+	r, err := git.PlainOpen(repo)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commits, err := r.Log(&git.LogOptions{All: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	commits.ForEach(func(c *object.Commit) error {
+		n++
+		return nil
+	})
+	if n != 8 {
+		t.Fatal("Expected 8 commits, got", n)
+	}
+}
+
+func TestRemote(t *testing.T) {
+	repo, clean := testRepository(t)
+	defer clean()
+	cache, err := ioutil.TempDir("", "dsd-git-cache")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(cache)
+
+	p, err := open("file://"+filepath.ToSlash(repo), "dsd", nil, cache)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testProvider(t, p)
+
+	// Other clients see the pushed version
+	local, err := Create("git+file://" + filepath.ToSlash(repo))
+	if err != nil {
+		t.Fatal(err)
+	}
+	v, err := local.GetCurrentVersion()
+	if err != nil || v.Name != "c" {
+		t.Fatal(v, err)
+	}
+}
+
+func TestInvalidServices(t *testing.T) {
+	_, err := Create("git+file:///nonexistent/repo.git")
+	if err == nil {
+		t.Fatal("Expected missing repository error")
+	}
+	_, err = Create("git+file:///nonexistent/repo.git?wadus=1")
+	if err == nil {
+		t.Fatal("Expected unknown option error")
+	}
+	_, err = Create("git+ftp://host/repo.git")
+	if err == nil {
+		t.Fatal("Expected unknown scheme error")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) types.Provider {
+		repo, clean := testRepository(t)
+		t.Cleanup(clean)
+		p, err := Create("git+file://" + filepath.ToSlash(repo))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	})
+}
+
+func TestRemoteConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) types.Provider {
+		repo, clean := testRepository(t)
+		t.Cleanup(clean)
+		cache, err := ioutil.TempDir("", "dsd-git-cache")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { os.RemoveAll(cache) })
+		p, err := open("file://"+filepath.ToSlash(repo), "dsd", nil, cache)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	})
+}
@@ -0,0 +1,275 @@
+package http
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidmanzanares/dsd/internal/fileio"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// ErrReadOnly is returned when pushing to an HTTP service which doesn't accept uploads
+var ErrReadOnly = errors.New("HTTP service is read-only")
+
+// HTTP is a provider which downloads the VERSION/assets layout from a web server
+// Uploads are only accepted by servers supporting them, like Server
+type HTTP struct {
+	url     url.URL
+	headers http.Header
+	client  *http.Client
+
+	// The last version is cached to poll with If-None-Match
+	mutex   sync.Mutex
+	etag    string
+	version types.Version
+}
+
+// Create returns an HTTP provider for service
+// Options are set in the URL fragment, which is never sent to the server:
+// https://cdn.example.com/dev#bearer=<token>&header=X-Api-Key:<key>&ca=/etc/ssl/my-ca.pem
+func Create(service string) (types.Provider, error) {
+	u, err := url.Parse(service)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, errors.New("HTTP service must begin with http:// or https://")
+	}
+	options, err := url.ParseQuery(u.Fragment)
+	if err != nil {
+		return nil, err
+	}
+	u.Fragment = ""
+	u.Path = strings.TrimSuffix(u.Path, "/")
+
+	h := &HTTP{url: *u, headers: make(http.Header), client: &http.Client{}}
+	for k, values := range options {
+		for _, v := range values {
+			switch k {
+			case "header":
+				parts := strings.SplitN(v, ":", 2)
+				if len(parts) != 2 {
+					return nil, fmt.Errorf("Invalid HTTP header option, expected <name>:<value>: %s", v)
+				}
+				h.headers.Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+			case "bearer":
+				h.headers.Set("Authorization", "Bearer "+v)
+			case "ca":
+				pem, err := ioutil.ReadFile(v)
+				if err != nil {
+					return nil, err
+				}
+				pool := x509.NewCertPool()
+				if !pool.AppendCertsFromPEM(pem) {
+					return nil, fmt.Errorf("No certificates found in CA bundle %s", v)
+				}
+				h.client.Transport = &http.Transport{
+					Proxy:           http.ProxyFromEnvironment,
+					TLSClientConfig: &tls.Config{RootCAs: pool},
+				}
+			default:
+				return nil, fmt.Errorf("Unknown HTTP option: %s", k)
+			}
+		}
+	}
+	return h, nil
+}
+
+// GetAsset streams the asset name into writer
+func (h *HTTP) GetAsset(name string, writer io.Writer) error {
+	resp, err := h.get("/assets/"+name, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return statusError(resp)
+	}
+	_, err = io.Copy(writer, fileio.TransientReader{R: resp.Body})
+	return err
+}
+
+// PushAsset uploads the asset name, streaming it from reader
+func (h *HTTP) PushAsset(name string, reader io.Reader) error {
+	return h.put("/assets/"+name, reader)
+}
+
+// GetCurrentVersion gets the VERSION file, its download is skipped if its ETag didn't change
+func (h *HTTP) GetCurrentVersion() (types.Version, error) {
+	h.mutex.Lock()
+	defer h.mutex.Unlock()
+
+	resp, err := h.get("/VERSION", h.etag)
+	if err != nil {
+		return types.Version{}, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotModified {
+		return h.version, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		return types.Version{}, statusError(resp)
+	}
+	var buffer bytes.Buffer
+	_, err = io.Copy(&buffer, resp.Body)
+	if err != nil {
+		return types.Version{}, err
+	}
+	v, err := types.DeserializeVersion(buffer.Bytes())
+	if err != nil {
+		return v, fmt.Errorf("Error %s\nHTTP server returned: \"%s\"\n", err.Error(), buffer.String())
+	}
+	h.etag = resp.Header.Get("ETag")
+	h.version = v
+	return v, nil
+}
+
+// PushVersion uploads the VERSION file
+func (h *HTTP) PushVersion(v types.Version) error {
+	buff, err := v.Serialize()
+	if err != nil {
+		return err
+	}
+	return h.put("/VERSION", bytes.NewReader(buff))
+}
+
+// WatchVersions listens to the server-sent events of servers like Server
+// The channel is closed if the server doesn't support them
+func (h *HTTP) WatchVersions(stop <-chan struct{}) <-chan types.Version {
+	versions := make(chan types.Version)
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stop
+		cancel()
+	}()
+	go func() {
+		defer close(versions)
+		retry := time.Second
+		for {
+			supported, err := h.watch(ctx, versions)
+			if !supported {
+				return
+			}
+			if err != nil {
+				retry *= 2
+				if retry > 30*time.Second {
+					retry = 30 * time.Second
+				}
+			} else {
+				retry = time.Second
+			}
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(retry):
+			}
+		}
+	}()
+	return versions
+}
+
+// watch reads the server-sent events until the connection ends
+// supported is false when the server doesn't stream events or when the context is done
+func (h *HTTP) watch(ctx context.Context, versions chan<- types.Version) (supported bool, err error) {
+	req, err := h.request(http.MethodGet, "/events", nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := h.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return ctx.Err() == nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || !strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream") {
+		return resp.StatusCode >= 500, statusError(resp)
+	}
+
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if !strings.HasPrefix(line, "data:") {
+			continue
+		}
+		v, err := types.DeserializeVersion([]byte(strings.TrimSpace(line[len("data:"):])))
+		if err != nil {
+			return true, err
+		}
+		select {
+		case versions <- v:
+		case <-ctx.Done():
+			return false, nil
+		}
+	}
+	return ctx.Err() == nil, scanner.Err()
+}
+
+func (h *HTTP) get(path string, etag string) (*http.Response, error) {
+	req, err := h.request(http.MethodGet, path, nil)
+	if err != nil {
+		return nil, err
+	}
+	if etag != "" {
+		req.Header.Set("If-None-Match", etag)
+	}
+	resp, err := h.client.Do(req)
+	return resp, types.WrapError(types.ErrTransient, err)
+}
+
+func (h *HTTP) put(path string, reader io.Reader) error {
+	req, err := h.request(http.MethodPut, path, reader)
+	if err != nil {
+		return err
+	}
+	resp, err := h.client.Do(req)
+	if err != nil {
+		return types.WrapError(types.ErrTransient, err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusMethodNotAllowed || resp.StatusCode == http.StatusNotImplemented {
+		return ErrReadOnly
+	}
+	if resp.StatusCode/100 != 2 {
+		return statusError(resp)
+	}
+	return nil
+}
+
+func (h *HTTP) request(method string, path string, body io.Reader) (*http.Request, error) {
+	u := h.url
+	u.Path += path
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range h.headers {
+		req.Header[k] = v
+	}
+	return req, nil
+}
+
+// statusError returns the error for an unexpected response, marked with the matching types error
+func statusError(resp *http.Response) error {
+	err := fmt.Errorf("HTTP error on %s %s: %s", resp.Request.Method, resp.Request.URL.Path, resp.Status)
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return types.WrapError(types.ErrNotFound, err)
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return types.WrapError(types.ErrUnauthorized, err)
+	case resp.StatusCode == http.StatusRequestTimeout || resp.StatusCode == http.StatusTooManyRequests ||
+		resp.StatusCode >= 500:
+		return types.WrapError(types.ErrTransient, err)
+	}
+	return err
+}
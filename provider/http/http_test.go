@@ -0,0 +1,178 @@
+package http
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// testServer serves files with ETags, counting the requests answered with 304 Not Modified
+type testServer struct {
+	files       map[string][]byte
+	token       string
+	notModified int
+}
+
+func (s *testServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	if s.token != "" && r.Header.Get("Authorization") != "Bearer "+s.token {
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+	f, ok := s.files[r.URL.Path]
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+	hash := sha256.Sum256(f)
+	etag := `"` + hex.EncodeToString(hash[:]) + `"`
+	if r.Header.Get("If-None-Match") == etag {
+		s.notModified++
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("ETag", etag)
+	w.Write(f)
+}
+
+func newTestServer(t *testing.T, v types.Version) *testServer {
+	version, err := v.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &testServer{files: map[string][]byte{
+		"/dev/VERSION":                      version,
+		"/dev/assets/" + v.Name + ".tar.gz": []byte("holamundo"),
+	}}
+}
+
+func TestGetVersionAndAsset(t *testing.T) {
+	v := types.Version{Name: "wadus", Time: time.Now().Truncate(time.Second)}
+	server := newTestServer(t, v)
+	ts := httptest.NewServer(server)
+	defer ts.Close()
+
+	h, err := Create(ts.URL + "/dev/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		v2, err := h.GetCurrentVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if v2.Name != v.Name || !v2.Time.Equal(v.Time) {
+			t.Fatal(v2)
+		}
+	}
+	if server.notModified != 2 {
+		t.Fatal("Expected 2 Not Modified responses, got", server.notModified)
+	}
+
+	var buff bytes.Buffer
+	err = h.GetAsset(v.Name+".tar.gz", &buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buff.String() != "holamundo" {
+		t.Fatal(buff.String())
+	}
+	err = h.GetAsset("missing", &buff)
+	if err == nil {
+		t.Fatal("Expected not found error")
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(t, types.Version{Name: "wadus"}))
+	defer ts.Close()
+
+	h, err := Create(ts.URL + "/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.PushAsset("a", strings.NewReader("a")) != ErrReadOnly {
+		t.Fatal("Expected read-only error")
+	}
+	if h.PushVersion(types.Version{Name: "a"}) != ErrReadOnly {
+		t.Fatal("Expected read-only error")
+	}
+}
+
+func TestBearerAndCA(t *testing.T) {
+	v := types.Version{Name: "wadus", Time: time.Now()}
+	server := newTestServer(t, v)
+	server.token = "secret"
+	ts := httptest.NewUnstartedServer(server)
+	// The unknown certificate authority test makes the server log handshake errors
+	ts.Config.ErrorLog = log.New(ioutil.Discard, "", 0)
+	ts.StartTLS()
+	defer ts.Close()
+
+	ca, err := ioutil.TempFile("", "dsd-ca")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(ca.Name())
+	pem.Encode(ca, &pem.Block{Type: "CERTIFICATE", Bytes: ts.Certificate().Raw})
+	ca.Close()
+
+	h, err := Create(ts.URL + "/dev#ca=" + ca.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.GetCurrentVersion()
+	if err == nil {
+		t.Fatal("Expected unauthorized error")
+	}
+
+	h, err = Create(ts.URL + "/dev#bearer=secret&ca=" + ca.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := h.GetCurrentVersion()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if v2.Name != v.Name {
+		t.Fatal(v2)
+	}
+
+	h, err = Create(ts.URL + "/dev#bearer=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = h.GetCurrentVersion()
+	if err == nil {
+		t.Fatal("Expected unknown certificate authority error")
+	}
+}
+
+func TestInvalidOptions(t *testing.T) {
+	_, err := Create("https://localhost/dev#wadus=1")
+	if err == nil {
+		t.Fatal("Expected unknown option error")
+	}
+	_, err = Create("https://localhost/dev#header=invalid")
+	if err == nil {
+		t.Fatal("Expected invalid header error")
+	}
+	_, err = Create("ftp://localhost/dev")
+	if err == nil {
+		t.Fatal("Expected invalid scheme error")
+	}
+}
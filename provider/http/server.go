@@ -0,0 +1,319 @@
+package http
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// DefaultServerPolling for Server when ServerConf.Polling is set to the zero time.Duration
+const DefaultServerPolling = 5 * time.Second
+
+// maxWait bounds the long-polling time requested by clients
+const maxWait = 5 * time.Minute
+
+// ServerConf is the Server's configuration
+type ServerConf struct {
+	// Token, if set, is required as a bearer token by every download
+	Token string
+	// UploadToken, if set, enables uploads authenticated with it as a bearer token
+	UploadToken string
+	// Polling is the interval used to detect versions pushed to the provider by others
+	Polling time.Duration
+}
+
+// Server exposes a provider over HTTP with the VERSION/assets layout used by the HTTP provider
+// GET /VERSION?wait=<duration> waits until the version differs from the If-None-Match ETag
+// GET /events streams the version changes as server-sent events
+type Server struct {
+	provider types.Provider
+	conf     ServerConf
+
+	mutex   sync.Mutex
+	version []byte
+	etag    string
+	// pollErr is the error of the last version polling
+	pollErr error
+	// changed is closed and replaced every time the version changes
+	changed chan struct{}
+	stop    chan struct{}
+}
+
+// NewServer returns a Server exposing p, Close must be called to stop its version polling
+func NewServer(p types.Provider, conf ServerConf) *Server {
+	if conf.Polling == 0 {
+		conf.Polling = DefaultServerPolling
+	}
+	s := &Server{provider: p, conf: conf, changed: make(chan struct{}), stop: make(chan struct{})}
+	s.poll()
+	go func() {
+		for {
+			select {
+			case <-s.stop:
+				return
+			case <-time.After(s.conf.Polling):
+				s.poll()
+			}
+		}
+	}()
+	return s
+}
+
+// Close stops the version polling
+func (s *Server) Close() {
+	close(s.stop)
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodPut {
+		if s.conf.UploadToken == "" {
+			http.Error(w, "Uploads are disabled", http.StatusMethodNotAllowed)
+			return
+		}
+		if !authorized(r, s.conf.UploadToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	} else if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		if s.conf.Token != "" && !authorized(r, s.conf.Token) && !authorized(r, s.conf.UploadToken) {
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	} else {
+		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	if r.URL.Path == "/VERSION" {
+		if r.Method == http.MethodPut {
+			s.putVersion(w, r)
+		} else {
+			s.getVersion(w, r)
+		}
+	} else if r.URL.Path == "/events" && r.Method != http.MethodPut {
+		s.events(w, r)
+	} else if strings.HasPrefix(r.URL.Path, "/assets/") {
+		name := r.URL.Path[len("/assets/"):]
+		if name == "" || path.Clean("/"+name) != "/"+name {
+			http.Error(w, "Invalid asset name", http.StatusBadRequest)
+			return
+		}
+		if r.Method == http.MethodPut {
+			s.putAsset(w, r, name)
+		} else if r.Method == http.MethodHead {
+			s.headAsset(w, r, name)
+		} else {
+			s.getAsset(w, r, name)
+		}
+	} else {
+		http.NotFound(w, r)
+	}
+}
+
+func (s *Server) getVersion(w http.ResponseWriter, r *http.Request) {
+	version, etag, changed := s.current()
+	if wait := r.URL.Query().Get("wait"); wait != "" && etag != "" && r.Header.Get("If-None-Match") == etag {
+		d, err := time.ParseDuration(wait)
+		if err != nil {
+			http.Error(w, "Invalid wait duration", http.StatusBadRequest)
+			return
+		}
+		if d > maxWait {
+			d = maxWait
+		}
+		select {
+		case <-changed:
+		case <-time.After(d):
+		case <-r.Context().Done():
+			return
+		}
+		version, etag, _ = s.current()
+	}
+	if version == nil {
+		s.mutex.Lock()
+		err := s.pollErr
+		s.mutex.Unlock()
+		if err == nil || errors.Is(err, types.ErrNotFound) {
+			http.Error(w, "Nothing deployed", http.StatusNotFound)
+		} else {
+			http.Error(w, err.Error(), errorStatus(err))
+		}
+		return
+	}
+	w.Header().Set("ETag", etag)
+	if r.Header.Get("If-None-Match") == etag {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Write(version)
+}
+
+func (s *Server) putVersion(w http.ResponseWriter, r *http.Request) {
+	buffer, err := ioutil.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	v, err := types.DeserializeVersion(buffer)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	err = s.provider.PushVersion(v)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	s.poll()
+}
+
+func (s *Server) events(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	var sent string
+	for {
+		version, etag, changed := s.current()
+		if version != nil && etag != sent {
+			_, err := fmt.Fprintf(w, "event: version\ndata: %s\n\n", version)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+			sent = etag
+		}
+		select {
+		case <-changed:
+		case <-time.After(30 * time.Second):
+			// Keep-alive comment, detecting closed connections
+			_, err := io.WriteString(w, ":\n\n")
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		case <-r.Context().Done():
+			return
+		}
+	}
+}
+
+func (s *Server) getAsset(w http.ResponseWriter, r *http.Request, name string) {
+	cw := &checkedWriter{w: w}
+	err := s.provider.GetAsset(name, cw)
+	if err != nil {
+		if !cw.written {
+			http.Error(w, err.Error(), errorStatus(err))
+		}
+		log.Println(err)
+	}
+}
+
+// headAsset reports if the asset exists, the provider stops sending it after its first write
+func (s *Server) headAsset(w http.ResponseWriter, r *http.Request, name string) {
+	err := s.provider.GetAsset(name, headWriter{})
+	if err != nil && !errors.Is(err, errHeadDone) {
+		http.Error(w, err.Error(), errorStatus(err))
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+var errHeadDone = errors.New("HEAD request done")
+
+// headWriter fails every write, aborting the asset download
+type headWriter struct{}
+
+func (headWriter) Write(p []byte) (int, error) {
+	return 0, errHeadDone
+}
+
+func (s *Server) putAsset(w http.ResponseWriter, r *http.Request, name string) {
+	err := s.provider.PushAsset(name, r.Body)
+	if err != nil {
+		log.Println(err)
+		http.Error(w, err.Error(), errorStatus(err))
+	}
+}
+
+// errorStatus returns the status code reporting the provider error err
+// Authorization errors of the provider are the server's problem, they aren't reported as the client's
+func errorStatus(err error) int {
+	if errors.Is(err, types.ErrNotFound) {
+		return http.StatusNotFound
+	}
+	if errors.Is(err, types.ErrTransient) {
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadGateway
+}
+
+// authorized checks that r has token as its bearer token, empty tokens are never authorized
+func authorized(r *http.Request, token string) bool {
+	expected := []byte("Bearer " + token)
+	return token != "" && subtle.ConstantTimeCompare([]byte(r.Header.Get("Authorization")), expected) == 1
+}
+
+// current returns the serialized version, its ETag and the channel closed when it changes
+func (s *Server) current() ([]byte, string, chan struct{}) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.version, s.etag, s.changed
+}
+
+// poll gets the current version from the provider, notifying changes to waiting clients
+func (s *Server) poll() {
+	v, err := s.provider.GetCurrentVersion()
+	s.mutex.Lock()
+	s.pollErr = err
+	s.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	version, err := v.Serialize()
+	if err != nil {
+		return
+	}
+	hash := sha256.Sum256(version)
+	etag := `"` + hex.EncodeToString(hash[:16]) + `"`
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if etag == s.etag {
+		return
+	}
+	s.version = version
+	s.etag = etag
+	close(s.changed)
+	s.changed = make(chan struct{})
+}
+
+// checkedWriter tracks if anything was written, errors can only be reported with a status before writing
+type checkedWriter struct {
+	w       io.Writer
+	written bool
+}
+
+func (c *checkedWriter) Write(p []byte) (int, error) {
+	c.written = true
+	return c.w.Write(p)
+}
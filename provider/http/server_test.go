@@ -0,0 +1,301 @@
+package http
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/provider/file"
+	"github.com/davidmanzanares/dsd/provider/memory"
+	"github.com/davidmanzanares/dsd/provider/providertest"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+func testServe(t *testing.T, conf ServerConf) (*httptest.Server, types.Provider, func()) {
+	dir, err := ioutil.TempDir("", "dsd-serve-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	backend, err := file.Create("file://" + dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := NewServer(backend, conf)
+	ts := httptest.NewServer(server)
+	return ts, backend, func() {
+		ts.Close()
+		server.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestServerUploads(t *testing.T) {
+	ts, backend, clean := testServe(t, ServerConf{UploadToken: "secret"})
+	defer clean()
+
+	h, err := Create(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if !errors.Is(err, types.ErrUnauthorized) {
+		t.Fatal("Expected unauthorized error", err)
+	}
+
+	h, err = Create(ts.URL + "#bearer=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.PushAsset("../VERSION", strings.NewReader("holamundo"))
+	if err == nil {
+		t.Fatal("Expected invalid name error")
+	}
+	err = h.PushVersion(types.Version{Name: "a", Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var buff bytes.Buffer
+	err = backend.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "holamundo" {
+		t.Fatal(buff.String(), err)
+	}
+	v, err := h.GetCurrentVersion()
+	if err != nil || v.Name != "a" {
+		t.Fatal(v, err)
+	}
+	buff.Reset()
+	err = h.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "holamundo" {
+		t.Fatal(buff.String(), err)
+	}
+}
+
+func TestServerReadOnly(t *testing.T) {
+	ts, _, clean := testServe(t, ServerConf{})
+	defer clean()
+
+	h, err := Create(ts.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.PushAsset("a", strings.NewReader("a")) != ErrReadOnly {
+		t.Fatal("Expected read-only error")
+	}
+	_, err = h.GetCurrentVersion()
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected not found error, nothing deployed", err)
+	}
+}
+
+// sentProvider counts the asset bytes accepted by the writers of GetAsset
+type sentProvider struct {
+	types.Provider
+	sent int
+}
+
+func (p *sentProvider) GetAsset(name string, writer io.Writer) error {
+	return p.Provider.GetAsset(name, writerFunc(func(b []byte) (int, error) {
+		n, err := writer.Write(b)
+		p.sent += n
+		return n, err
+	}))
+}
+
+type writerFunc func(b []byte) (int, error)
+
+func (f writerFunc) Write(b []byte) (int, error) {
+	return f(b)
+}
+
+func TestServerHead(t *testing.T) {
+	backend := &sentProvider{Provider: memory.New()}
+	backend.PushAsset("a.tar.gz", bytes.NewReader(make([]byte, 1<<20)))
+	server := NewServer(backend, ServerConf{Token: "secret"})
+	ts := httptest.NewServer(server)
+	defer server.Close()
+	defer ts.Close()
+
+	head := func(name, token string) int {
+		req, _ := http.NewRequest(http.MethodHead, ts.URL+"/assets/"+name, nil)
+		req.Header.Set("Authorization", "Bearer "+token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if status := head("a.tar.gz", "secret"); status != http.StatusOK || backend.sent != 0 {
+		t.Fatal(status, backend.sent)
+	}
+	if status := head("b.tar.gz", "secret"); status != http.StatusNotFound {
+		t.Fatal(status)
+	}
+	if status := head("a.tar.gz", "secrets"); status != http.StatusUnauthorized {
+		t.Fatal(status)
+	}
+}
+
+// failingProvider fails every operation with err
+type failingProvider struct {
+	err error
+}
+
+func (p failingProvider) GetAsset(name string, writer io.Writer) error  { return p.err }
+func (p failingProvider) PushAsset(name string, reader io.Reader) error { return p.err }
+func (p failingProvider) GetCurrentVersion() (types.Version, error)     { return types.Version{}, p.err }
+func (p failingProvider) PushVersion(v types.Version) error             { return p.err }
+
+func TestServerErrors(t *testing.T) {
+	cases := []struct {
+		err      error
+		expected error
+	}{
+		{types.WrapError(types.ErrTransient, errors.New("Connection lost")), types.ErrTransient},
+		{fmt.Errorf("Backend: %w", types.ErrNotFound), types.ErrNotFound},
+		// Backend authorization errors aren't the client's fault
+		{types.WrapError(types.ErrUnauthorized, errors.New("Access denied")), nil},
+	}
+	for _, c := range cases {
+		server := NewServer(failingProvider{c.err}, ServerConf{UploadToken: "secret"})
+		ts := httptest.NewServer(server)
+		h, err := Create(ts.URL + "#bearer=secret")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buff bytes.Buffer
+		errs := []error{h.GetAsset("a", &buff), h.PushAsset("a", strings.NewReader("a")), h.PushVersion(types.Version{Name: "a"})}
+		_, err = h.GetCurrentVersion()
+		errs = append(errs, err)
+		for _, err := range errs {
+			if err == nil {
+				t.Error("Expected error for", c.err)
+			} else if c.expected != nil && !errors.Is(err, c.expected) {
+				t.Error("Expected", c.expected, "got", err)
+			} else if c.expected == nil && errors.Is(err, types.ErrUnauthorized) {
+				t.Error("Unexpected unauthorized error", err)
+			}
+		}
+		ts.Close()
+		server.Close()
+	}
+}
+
+func TestServerLongPolling(t *testing.T) {
+	ts, _, clean := testServe(t, ServerConf{UploadToken: "secret"})
+	defer clean()
+
+	h, err := Create(ts.URL + "#bearer=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = h.PushVersion(types.Version{Name: "a", Time: time.Now()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.Get(ts.URL + "/VERSION")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	etag := resp.Header.Get("ETag")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		h.PushVersion(types.Version{Name: "b", Time: time.Now()})
+	}()
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodGet, ts.URL+"/VERSION?wait=10s", nil)
+	req.Header.Set("If-None-Match", etag)
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || time.Since(start) > 5*time.Second {
+		t.Fatal(resp.Status, time.Since(start))
+	}
+	b, _ := ioutil.ReadAll(resp.Body)
+	v, err := types.DeserializeVersion(b)
+	if err != nil || v.Name != "b" {
+		t.Fatal(v, err)
+	}
+}
+
+func TestServerEvents(t *testing.T) {
+	ts, _, clean := testServe(t, ServerConf{UploadToken: "secret"})
+	defer clean()
+
+	h, err := Create(ts.URL + "#bearer=secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	versions := h.(types.VersionWatcher).WatchVersions(stop)
+	for _, name := range []string{"a", "b"} {
+		err = h.PushVersion(types.Version{Name: name, Time: time.Now()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		select {
+		case v := <-versions:
+			if v.Name != name {
+				t.Fatal(v)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatal("Version event not received")
+		}
+	}
+	close(stop)
+	for range versions {
+	}
+}
+
+func TestWatchUnsupported(t *testing.T) {
+	ts := httptest.NewServer(newTestServer(t, types.Version{Name: "wadus"}))
+	defer ts.Close()
+
+	h, err := Create(ts.URL + "/dev")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stop := make(chan struct{})
+	defer close(stop)
+	select {
+	case _, ok := <-h.(types.VersionWatcher).WatchVersions(stop):
+		if ok {
+			t.Fatal("Expected closed channel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Channel not closed")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) types.Provider {
+		server := NewServer(memory.New(), ServerConf{UploadToken: "uploadToken"})
+		ts := httptest.NewServer(server)
+		t.Cleanup(func() {
+			ts.Close()
+			server.Close()
+		})
+		p, err := Create(ts.URL + "#bearer=uploadToken")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	})
+}
@@ -0,0 +1,126 @@
+package memory
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// Memory stores a service in memory, it's mainly intended for tests
+type Memory struct {
+	mutex    sync.Mutex
+	assets   map[string]asset
+	versions []types.Version
+}
+
+type asset struct {
+	data []byte
+	time time.Time
+}
+
+var services = make(map[string]*Memory)
+var servicesMutex sync.Mutex
+
+// Create returns the Memory provider named by service, like mem://name
+// Services with the same name share their storage during the process lifetime
+func Create(service string) (types.Provider, error) {
+	if !strings.HasPrefix(service, "mem://") {
+		return nil, errors.New("Memory service must begin with mem://")
+	}
+	name := service[len("mem://"):]
+	servicesMutex.Lock()
+	defer servicesMutex.Unlock()
+	m, ok := services[name]
+	if !ok {
+		m = New()
+		services[name] = m
+	}
+	return m, nil
+}
+
+// New returns an empty Memory provider, not shared with any mem:// service
+func New() *Memory {
+	return &Memory{assets: make(map[string]asset)}
+}
+
+func (m *Memory) GetAsset(name string, writer io.Writer) error {
+	m.mutex.Lock()
+	a, ok := m.assets[name]
+	m.mutex.Unlock()
+	if !ok {
+		return fmt.Errorf("Memory asset %s: %w", name, types.ErrNotFound)
+	}
+	_, err := writer.Write(a.data)
+	return err
+}
+
+func (m *Memory) PushAsset(name string, reader io.Reader) error {
+	var buffer bytes.Buffer
+	_, err := io.Copy(&buffer, reader)
+	if err != nil {
+		return err
+	}
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.assets[name] = asset{data: buffer.Bytes(), time: time.Now()}
+	return nil
+}
+
+func (m *Memory) GetCurrentVersion() (types.Version, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if len(m.versions) == 0 {
+		return types.Version{}, fmt.Errorf("Memory error getting version: %w", types.ErrNotFound)
+	}
+	return m.versions[len(m.versions)-1], nil
+}
+
+func (m *Memory) PushVersion(v types.Version) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.versions = append(m.versions, v)
+	return nil
+}
+
+// History returns the pushed versions, newest first
+func (m *Memory) History() ([]types.Version, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var versions []types.Version
+	for i := len(m.versions) - 1; i >= 0; i-- {
+		versions = append(versions, m.versions[i])
+	}
+	return versions, nil
+}
+
+// ListAssets lists every stored asset, sorted by name
+func (m *Memory) ListAssets() ([]types.Asset, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	var assets []types.Asset
+	for name, a := range m.assets {
+		assets = append(assets, types.Asset{Name: name, Size: int64(len(a.data)), Time: a.time})
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Name < assets[j].Name
+	})
+	return assets, nil
+}
+
+// DeleteAsset removes the asset name
+func (m *Memory) DeleteAsset(name string) error {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	if _, ok := m.assets[name]; !ok {
+		return fmt.Errorf("Memory asset %s: %w", name, types.ErrNotFound)
+	}
+	delete(m.assets, name)
+	return nil
+}
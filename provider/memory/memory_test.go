@@ -0,0 +1,98 @@
+package memory
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/provider/providertest"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+func TestAsset(t *testing.T) {
+	m := New()
+	err := m.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buff bytes.Buffer
+	err = m.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "holamundo" {
+		t.Fatal(buff.String(), err)
+	}
+	err = m.GetAsset("missing", &buff)
+	if err == nil {
+		t.Fatal("Expected not found error")
+	}
+}
+
+func TestVersion(t *testing.T) {
+	m := New()
+	_, err := m.GetCurrentVersion()
+	if err == nil {
+		t.Fatal("Expected error, nothing deployed")
+	}
+	m.PushVersion(types.Version{Name: "a", Time: time.Now()})
+	m.PushVersion(types.Version{Name: "b", Time: time.Now()})
+	v, err := m.GetCurrentVersion()
+	if err != nil || v.Name != "b" {
+		t.Fatal(v, err)
+	}
+	history, err := m.History()
+	if err != nil || len(history) != 2 || history[0].Name != "b" || history[1].Name != "a" {
+		t.Fatal(history, err)
+	}
+}
+
+func TestListDeleteAssets(t *testing.T) {
+	m := New()
+	m.PushAsset("b", strings.NewReader("hola"))
+	m.PushAsset("a", strings.NewReader("holamundo"))
+	assets, err := m.ListAssets()
+	if err != nil || len(assets) != 2 || assets[0].Name != "a" || assets[0].Size != 9 {
+		t.Fatal(assets, err)
+	}
+	err = m.DeleteAsset("a")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assets, err = m.ListAssets()
+	if err != nil || len(assets) != 1 || assets[0].Name != "b" {
+		t.Fatal(assets, err)
+	}
+}
+
+func TestSharedServices(t *testing.T) {
+	a, err := Create("mem://shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, err := Create("mem://shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	other, err := Create("mem://other")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a.PushVersion(types.Version{Name: "a"})
+	v, err := b.GetCurrentVersion()
+	if err != nil || v.Name != "a" {
+		t.Fatal(v, err)
+	}
+	_, err = other.GetCurrentVersion()
+	if err == nil {
+		t.Fatal("Services with different names must not share their storage")
+	}
+	_, err = Create("memory://shared")
+	if err == nil {
+		t.Fatal("Expected invalid URL error")
+	}
+}
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) types.Provider {
+		return New()
+	})
+}
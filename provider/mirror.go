@@ -0,0 +1,248 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+
+	"github.com/davidmanzanares/dsd/internal/fileio"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// Mirror returns a provider writing to every backend and reading from the first one which succeeds
+// Assets are pushed to every backend at the same time, the push fails if any backend fails
+// PushVersion fails without pushing anything if an asset push failed since the previous version and wasn't
+// pushed successfully later, runners never see versions whose assets aren't in every backend
+// Reads fail over to the next backend in order, downloads only if nothing was written yet
+// The returned provider implements types.AssetManager if every backend implements it
+func Mirror(backends ...types.Provider) types.Provider {
+	m := &mirror{backends: backends, failed: make(map[string]error)}
+	for _, b := range backends {
+		if _, ok := b.(types.AssetManager); !ok {
+			return m
+		}
+	}
+	return &mirrorManager{m}
+}
+
+type mirror struct {
+	backends []types.Provider
+
+	mutex sync.Mutex
+	// failed has the errors of the assets which failed to be pushed since the last PushVersion
+	failed map[string]error
+}
+
+func (m *mirror) GetAsset(name string, writer io.Writer) error {
+	var firstErr error
+	for i, b := range m.backends {
+		cw := &fileio.CountingWriter{W: writer}
+		err := b.GetAsset(name, cw)
+		if err == nil {
+			return nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if cw.N > 0 {
+			return err
+		}
+		if i+1 < len(m.backends) {
+			log.Println("Mirror error getting asset", name+":", err, "- trying the next backend")
+		}
+	}
+	return firstErr
+}
+
+func (m *mirror) PushAsset(name string, reader io.Reader) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.backends))
+	writers := make([]*io.PipeWriter, len(m.backends))
+	for i, b := range m.backends {
+		r, w := io.Pipe()
+		writers[i] = w
+		wg.Add(1)
+		go func(i int, b types.Provider) {
+			defer wg.Done()
+			errs[i] = b.PushAsset(name, r)
+			// Unblock the writes to a backend which failed before reading everything
+			r.CloseWithError(errBackendFailed)
+		}(i, b)
+	}
+	_, err := io.Copy(&fanOutWriter{writers: writers}, reader)
+	for _, w := range writers {
+		w.CloseWithError(err)
+	}
+	wg.Wait()
+	// Source errors are reported as they are, the backends only failed because of them
+	if err == nil || err == errBackendFailed {
+		err = joinErrors("pushing asset "+name, errs)
+	}
+
+	m.mutex.Lock()
+	if err != nil {
+		m.failed[name] = err
+	} else {
+		delete(m.failed, name)
+	}
+	m.mutex.Unlock()
+	return err
+}
+
+func (m *mirror) GetCurrentVersion() (types.Version, error) {
+	var firstErr error
+	for i, b := range m.backends {
+		v, err := b.GetCurrentVersion()
+		if err == nil {
+			return v, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if i+1 < len(m.backends) && !errors.Is(err, types.ErrNotFound) {
+			log.Println("Mirror error getting version:", err, "- trying the next backend")
+		}
+	}
+	return types.Version{}, firstErr
+}
+
+func (m *mirror) PushVersion(v types.Version) error {
+	m.mutex.Lock()
+	var pushErr error
+	for _, err := range m.failed {
+		pushErr = err
+	}
+	m.failed = make(map[string]error)
+	m.mutex.Unlock()
+	if pushErr != nil {
+		return fmt.Errorf("Mirror version %s not pushed, an asset push failed: %w", v.Name, pushErr)
+	}
+	return m.each("pushing version "+v.Name, func(b types.Provider) error {
+		return b.PushVersion(v)
+	})
+}
+
+// each calls f with every backend at the same time
+func (m *mirror) each(action string, f func(b types.Provider) error) error {
+	var wg sync.WaitGroup
+	errs := make([]error, len(m.backends))
+	for i, b := range m.backends {
+		wg.Add(1)
+		go func(i int, b types.Provider) {
+			defer wg.Done()
+			errs[i] = f(b)
+		}(i, b)
+	}
+	wg.Wait()
+	return joinErrors(action, errs)
+}
+
+type mirrorManager struct {
+	*mirror
+}
+
+// ListAssets lists the assets of every backend, an asset is listed once even if many backends store it
+func (m *mirrorManager) ListAssets() ([]types.Asset, error) {
+	seen := make(map[string]bool)
+	var assets []types.Asset
+	for _, b := range m.backends {
+		list, err := b.(types.AssetManager).ListAssets()
+		if err != nil {
+			return nil, err
+		}
+		for _, a := range list {
+			if !seen[a.Name] {
+				seen[a.Name] = true
+				assets = append(assets, a)
+			}
+		}
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Name < assets[j].Name
+	})
+	return assets, nil
+}
+
+// DeleteAsset deletes the asset from every backend storing it
+func (m *mirrorManager) DeleteAsset(name string) error {
+	var mutex sync.Mutex
+	found := false
+	err := m.each("deleting asset "+name, func(b types.Provider) error {
+		err := b.(types.AssetManager).DeleteAsset(name)
+		if errors.Is(err, types.ErrNotFound) {
+			return nil
+		}
+		if err == nil {
+			mutex.Lock()
+			found = true
+			mutex.Unlock()
+		}
+		return err
+	})
+	if err == nil && !found {
+		return fmt.Errorf("Mirror asset %s: %w", name, types.ErrNotFound)
+	}
+	return err
+}
+
+var errBackendFailed = errors.New("Mirror backend failed")
+
+// fanOutWriter writes to every writer, writers which fail are skipped
+// It only fails when every writer failed
+type fanOutWriter struct {
+	writers []*io.PipeWriter
+	failed  []bool
+}
+
+func (f *fanOutWriter) Write(p []byte) (int, error) {
+	if f.failed == nil {
+		f.failed = make([]bool, len(f.writers))
+	}
+	ok := false
+	for i, w := range f.writers {
+		if f.failed[i] {
+			continue
+		}
+		_, err := w.Write(p)
+		if err != nil {
+			f.failed[i] = true
+			continue
+		}
+		ok = true
+	}
+	if !ok {
+		return 0, errBackendFailed
+	}
+	return len(p), nil
+}
+
+// joinErrors returns nil if every error is nil, or an error listing them
+// The returned error is only transient if every failure was transient
+func joinErrors(action string, errs []error) error {
+	var messages []string
+	var failed []int
+	transient := true
+	for i, err := range errs {
+		if err == nil {
+			continue
+		}
+		failed = append(failed, i)
+		transient = transient && errors.Is(err, types.ErrTransient)
+		messages = append(messages, fmt.Sprintf("backend %d: %s", i+1, err.Error()))
+	}
+	if len(failed) == 0 {
+		return nil
+	}
+	if len(failed) == 1 {
+		return fmt.Errorf("Mirror error %s: backend %d: %w", action, failed[0]+1, errs[failed[0]])
+	}
+	err := fmt.Errorf("Mirror error %s: %s", action, strings.Join(messages, ", "))
+	if transient {
+		return types.WrapError(types.ErrTransient, err)
+	}
+	return err
+}
@@ -0,0 +1,172 @@
+package provider
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/davidmanzanares/dsd/provider/memory"
+	"github.com/davidmanzanares/dsd/provider/providertest"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+func TestMirrorPush(t *testing.T) {
+	a, b := memory.New(), memory.New()
+	p := Mirror(a, b)
+	err := p.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.PushVersion(types.Version{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, backend := range []*memory.Memory{a, b} {
+		var buff bytes.Buffer
+		err = backend.GetAsset("a.tar.gz", &buff)
+		if err != nil || buff.String() != "holamundo" {
+			t.Fatal("Backend", i, buff.String(), err)
+		}
+		v, err := backend.GetCurrentVersion()
+		if err != nil || v.Name != "a" {
+			t.Fatal("Backend", i, v, err)
+		}
+	}
+}
+
+func TestMirrorFailover(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 10, err: errTransient}
+	b := memory.New()
+	b.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	b.PushVersion(types.Version{Name: "a"})
+	p := Mirror(flaky, b)
+
+	var buff bytes.Buffer
+	err := p.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "holamundo" {
+		t.Fatal(buff.String(), err)
+	}
+	v, err := p.GetCurrentVersion()
+	if err != nil || v.Name != "a" {
+		t.Fatal(v, err)
+	}
+
+	// Every backend failed, the error of the first one is returned
+	_, err = Mirror(flaky, memory.New()).GetCurrentVersion()
+	if !errors.Is(err, types.ErrTransient) {
+		t.Fatal("Expected the first backend error", err)
+	}
+}
+
+func TestMirrorPartialDownload(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 1, err: errTransient, partial: true}
+	flaky.Memory.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	b := memory.New()
+	b.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	var buff bytes.Buffer
+	err := Mirror(flaky, b).GetAsset("a.tar.gz", &buff)
+	if !errors.Is(err, types.ErrTransient) {
+		t.Fatal("Partial downloads can't fail over", buff.String(), err)
+	}
+}
+
+func TestMirrorFailedPush(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 1, err: types.ErrUnauthorized}
+	b := memory.New()
+	p := Mirror(b, flaky)
+	err := p.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if !errors.Is(err, types.ErrUnauthorized) {
+		t.Fatal("Expected the backend error", err)
+	}
+	// The healthy backend received the whole asset anyway
+	var buff bytes.Buffer
+	err = b.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "holamundo" {
+		t.Fatal(buff.String(), err)
+	}
+
+	err = p.PushVersion(types.Version{Name: "a"})
+	if !errors.Is(err, types.ErrUnauthorized) {
+		t.Fatal("Versions can't be pushed after a failed asset push", err)
+	}
+	if _, err := b.GetCurrentVersion(); !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Version pushed to a backend", err)
+	}
+
+	// Pushing the asset again fixes it
+	err = p.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.PushVersion(types.Version{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMirrorRetry(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 1, err: errTransient}
+	p := WithRetry(Mirror(memory.New(), flaky), testPolicy)
+	err := p.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.PushVersion(types.Version{Name: "a"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestMirrorAssetManager(t *testing.T) {
+	a, b := memory.New(), memory.New()
+	a.PushAsset("a.tar.gz", strings.NewReader("a"))
+	a.PushAsset("c.tar.gz", strings.NewReader("c"))
+	b.PushAsset("b.tar.gz", strings.NewReader("b"))
+	b.PushAsset("c.tar.gz", strings.NewReader("c"))
+	m, ok := Mirror(a, b).(types.AssetManager)
+	if !ok {
+		t.Fatal("types.AssetManager not implemented")
+	}
+	assets, err := m.ListAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, asset := range assets {
+		names = append(names, asset.Name)
+	}
+	if strings.Join(names, ",") != "a.tar.gz,b.tar.gz,c.tar.gz" {
+		t.Fatal(names)
+	}
+
+	err = m.DeleteAsset("c.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.DeleteAsset("a.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.DeleteAsset("a.tar.gz")
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected not found error", err)
+	}
+	assets, _ = m.ListAssets()
+	if len(assets) != 1 || assets[0].Name != "b.tar.gz" {
+		t.Fatal(assets)
+	}
+
+	if _, ok := Mirror(a, &flakyProvider{Memory: b}).(types.AssetManager); !ok {
+		t.Fatal("types.AssetManager not implemented")
+	}
+	if _, ok := Mirror(a, struct{ types.Provider }{b}).(types.AssetManager); ok {
+		t.Fatal("types.AssetManager implemented without it in every backend")
+	}
+}
+
+func TestMirrorConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) types.Provider {
+		return Mirror(memory.New(), memory.New())
+	})
+}
@@ -0,0 +1,325 @@
+// Package providertest checks that a types.Provider implementation follows the contract expected by dsd
+//
+// Providers check themselves by calling Run from a test:
+//
+//	func TestConformance(t *testing.T) {
+//		providertest.Run(t, func(t *testing.T) types.Provider {
+//			p, err := Create("myscheme://" + t.Name())
+//			if err != nil {
+//				t.Fatal(err)
+//			}
+//			return p
+//		})
+//	}
+package providertest
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/internal/fileio"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// Factory returns a new and empty provider for each test
+// Cleanups can be registered with t.Cleanup
+type Factory func(t *testing.T) types.Provider
+
+// LargeAssetSize is the size of the asset streamed by the large asset test
+var LargeAssetSize int64 = 32 << 20
+
+// Run runs the conformance tests as subtests of t, every subtest gets its own provider from factory
+// Optional interfaces, like types.AssetManager or types.VersionHistory, are tested if the provider implements them
+func Run(t *testing.T, factory Factory) {
+	tests := []struct {
+		name string
+		f    func(t *testing.T, p types.Provider)
+	}{
+		{"MissingAsset", testMissingAsset},
+		{"MissingVersion", testMissingVersion},
+		{"AssetRoundTrip", testAssetRoundTrip},
+		{"AssetOverwrite", testAssetOverwrite},
+		{"NestedAsset", testNestedAsset},
+		{"EmptyAsset", testEmptyAsset},
+		{"FailedPush", testFailedPush},
+		{"LargeAsset", testLargeAsset},
+		{"ConcurrentPushes", testConcurrentPushes},
+		{"VersionRoundTrip", testVersionRoundTrip},
+		{"AssetManager", testAssetManager},
+		{"VersionHistory", testVersionHistory},
+	}
+	for _, test := range tests {
+		test := test
+		t.Run(test.name, func(t *testing.T) {
+			test.f(t, factory(t))
+		})
+	}
+}
+
+func testMissingAsset(t *testing.T, p types.Provider) {
+	var buff bytes.Buffer
+	err := p.GetAsset("missing.tar.gz", &buff)
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected types.ErrNotFound, got", err)
+	}
+	if buff.Len() != 0 {
+		t.Fatal("Missing asset wrote", buff.Len(), "bytes")
+	}
+}
+
+func testMissingVersion(t *testing.T, p types.Provider) {
+	_, err := p.GetCurrentVersion()
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected types.ErrNotFound, got", err)
+	}
+}
+
+func testAssetRoundTrip(t *testing.T, p types.Provider) {
+	push(t, p, "a.tar.gz", "holamundo")
+	expectAsset(t, p, "a.tar.gz", "holamundo")
+}
+
+func testAssetOverwrite(t *testing.T, p types.Provider) {
+	push(t, p, "a.tar.gz", "holamundo")
+	push(t, p, "a.tar.gz", "adios")
+	expectAsset(t, p, "a.tar.gz", "adios")
+}
+
+func testNestedAsset(t *testing.T, p types.Provider) {
+	push(t, p, "folder/b.tar.gz", "hola")
+	expectAsset(t, p, "folder/b.tar.gz", "hola")
+	var buff bytes.Buffer
+	err := p.GetAsset("b.tar.gz", &buff)
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected types.ErrNotFound, got", err)
+	}
+}
+
+func testEmptyAsset(t *testing.T, p types.Provider) {
+	push(t, p, "empty", "")
+	expectAsset(t, p, "empty", "")
+}
+
+// failingReader returns n bytes and then an error
+type failingReader struct {
+	n int
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, errors.New("Read error")
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func testFailedPush(t *testing.T, p types.Provider) {
+	err := p.PushAsset("failed.tar.gz", &failingReader{n: 1 << 10})
+	if err == nil {
+		t.Fatal("Expected error pushing from a failing reader")
+	}
+	var buff bytes.Buffer
+	err = p.GetAsset("failed.tar.gz", &buff)
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Failed pushes must not store partial assets, got", buff.Len(), "bytes", err)
+	}
+
+	// A failed push doesn't replace the previous asset
+	push(t, p, "a.tar.gz", "holamundo")
+	p.PushAsset("a.tar.gz", &failingReader{n: 1 << 10})
+	expectAsset(t, p, "a.tar.gz", "holamundo")
+}
+
+func testLargeAsset(t *testing.T, p types.Provider) {
+	expected := sha256.New()
+	reader := io.TeeReader(io.LimitReader(rand.New(rand.NewSource(1)), LargeAssetSize), expected)
+	err := p.PushAsset("large.tar.gz", reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := sha256.New()
+	counter := &fileio.CountingWriter{W: got}
+	err = p.GetAsset("large.tar.gz", counter)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter.N != LargeAssetSize {
+		t.Fatal("Expected", LargeAssetSize, "bytes, got", counter.N)
+	}
+	if !bytes.Equal(got.Sum(nil), expected.Sum(nil)) {
+		t.Fatal("Large asset content mismatch")
+	}
+}
+
+func testConcurrentPushes(t *testing.T, p types.Provider) {
+	const n = 8
+	var wg sync.WaitGroup
+	errs := make(chan error, 2*n)
+	for i := 0; i < n; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			errs <- p.PushAsset(fmt.Sprintf("concurrent-%d", i), strings.NewReader(fmt.Sprint("content ", i)))
+		}(i)
+		go func(i int) {
+			defer wg.Done()
+			errs <- p.PushAsset("shared", strings.NewReader(strings.Repeat(fmt.Sprint(i), 1<<10)))
+		}(i)
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < n; i++ {
+		expectAsset(t, p, fmt.Sprintf("concurrent-%d", i), fmt.Sprint("content ", i))
+	}
+
+	// Concurrent pushes of the same asset store one of them, not a mix
+	var buff bytes.Buffer
+	err := p.GetAsset("shared", &buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	content := buff.String()
+	if len(content) != 1<<10 || strings.Count(content, content[:1]) != len(content) {
+		t.Fatal("Concurrent pushes mixed the asset content")
+	}
+}
+
+func testVersionRoundTrip(t *testing.T, p types.Provider) {
+	start := time.Now().Truncate(time.Second)
+	for i, name := range []string{"a", "b"} {
+		v := types.Version{Name: name, Time: start.Add(time.Duration(i) * time.Second)}
+		err := p.PushVersion(v)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := p.GetCurrentVersion()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got.Name != v.Name || !got.Time.Equal(v.Time) {
+			t.Fatal("Expected", v, "got", got)
+		}
+	}
+}
+
+func testAssetManager(t *testing.T, p types.Provider) {
+	m, ok := p.(types.AssetManager)
+	if !ok {
+		t.Skip("types.AssetManager not implemented")
+	}
+	assets, err := m.ListAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 0 {
+		t.Fatal("Expected no assets, got", assets)
+	}
+
+	push(t, p, "a.tar.gz", "holamundo")
+	push(t, p, "folder/b.tar.gz", "hola")
+	p.PushVersion(types.Version{Name: "a", Time: time.Now()})
+	assets, err = m.ListAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Slice(assets, func(i, j int) bool {
+		return assets[i].Name < assets[j].Name
+	})
+	if len(assets) != 2 || assets[0].Name != "a.tar.gz" || assets[1].Name != "folder/b.tar.gz" {
+		t.Fatal("Expected a.tar.gz and folder/b.tar.gz, got", assets)
+	}
+	if assets[0].Size != 9 || assets[1].Size != 4 {
+		t.Fatal("Wrong asset sizes", assets)
+	}
+
+	err = m.DeleteAsset("a.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var buff bytes.Buffer
+	err = p.GetAsset("a.tar.gz", &buff)
+	if !errors.Is(err, types.ErrNotFound) {
+		t.Fatal("Expected types.ErrNotFound after deleting, got", err)
+	}
+	assets, err = m.ListAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 1 || assets[0].Name != "folder/b.tar.gz" {
+		t.Fatal("Expected folder/b.tar.gz, got", assets)
+	}
+}
+
+func testVersionHistory(t *testing.T, p types.Provider) {
+	h, ok := p.(types.VersionHistory)
+	if !ok {
+		t.Skip("types.VersionHistory not implemented")
+	}
+	history, err := h.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 0 {
+		t.Fatal("Expected empty history, got", history)
+	}
+
+	start := time.Now().Truncate(time.Second)
+	for i, name := range []string{"a", "b", "c"} {
+		err := p.PushVersion(types.Version{Name: name, Time: start.Add(time.Duration(i) * time.Second)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// Assets pushed between versions aren't part of the history
+		push(t, p, name+".tar.gz", name)
+	}
+	history, err = h.History()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(history) != 3 || history[0].Name != "c" || history[1].Name != "b" || history[2].Name != "a" {
+		t.Fatal("Expected c, b, a, got", history)
+	}
+	if !history[2].Time.Equal(start) {
+		t.Fatal("Expected", start, "got", history[2].Time)
+	}
+}
+
+func push(t *testing.T, p types.Provider, name string, content string) {
+	t.Helper()
+	err := p.PushAsset(name, strings.NewReader(content))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func expectAsset(t *testing.T, p types.Provider, name string, content string) {
+	t.Helper()
+	var buff bytes.Buffer
+	err := p.GetAsset(name, &buff)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if buff.String() != content {
+		t.Fatal("Expected", name, "to contain", content, "got", buff.String())
+	}
+}
@@ -0,0 +1,407 @@
+// Package provider contains middlewares composable with any types.Provider
+package provider
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/davidmanzanares/dsd/types"
+)
+
+// RetryPolicy configures WithRetry, zero fields take the DefaultRetryPolicy values and negative ones disable them
+// Durations are strings in JSON, like "30s"
+type RetryPolicy struct {
+	// Attempts is the maximum number of attempts of every call, 1 disables the retries
+	Attempts int
+	// Backoff is the delay before the first retry, it's doubled after every retry up to MaxBackoff
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+	// Timeout aborts the calls which don't make progress for this long
+	// Streaming assets can take longer as long as they keep transferring data
+	Timeout time.Duration
+	// SpoolDir is the folder used to store the pushed assets which can't be read again nor regenerated, os.TempDir() by default
+	SpoolDir string
+}
+
+// DefaultRetryPolicy is used by WithRetry for the zero fields of its policy
+var DefaultRetryPolicy = RetryPolicy{Attempts: 4, Backoff: time.Second, MaxBackoff: 30 * time.Second, Timeout: 5 * time.Minute}
+
+func (p RetryPolicy) withDefaults() RetryPolicy {
+	if p.Attempts == 0 {
+		p.Attempts = DefaultRetryPolicy.Attempts
+	}
+	if p.Attempts < 0 {
+		p.Attempts = 1
+	}
+	if p.Backoff == 0 {
+		p.Backoff = DefaultRetryPolicy.Backoff
+	}
+	if p.MaxBackoff == 0 {
+		p.MaxBackoff = DefaultRetryPolicy.MaxBackoff
+	}
+	if p.Timeout == 0 {
+		p.Timeout = DefaultRetryPolicy.Timeout
+	}
+	return p
+}
+
+type retryPolicyJSON struct {
+	Attempts   int    `json:",omitempty"`
+	Backoff    string `json:",omitempty"`
+	MaxBackoff string `json:",omitempty"`
+	Timeout    string `json:",omitempty"`
+	SpoolDir   string `json:",omitempty"`
+}
+
+// MarshalJSON writes the durations of p as strings
+func (p RetryPolicy) MarshalJSON() ([]byte, error) {
+	j := retryPolicyJSON{Attempts: p.Attempts, SpoolDir: p.SpoolDir}
+	for _, d := range []struct {
+		s *string
+		d time.Duration
+	}{{&j.Backoff, p.Backoff}, {&j.MaxBackoff, p.MaxBackoff}, {&j.Timeout, p.Timeout}} {
+		if d.d != 0 {
+			*d.s = d.d.String()
+		}
+	}
+	return json.Marshal(j)
+}
+
+// UnmarshalJSON reads the durations of p from strings
+func (p *RetryPolicy) UnmarshalJSON(b []byte) error {
+	var j retryPolicyJSON
+	err := json.Unmarshal(b, &j)
+	if err != nil {
+		return err
+	}
+	policy := RetryPolicy{Attempts: j.Attempts, SpoolDir: j.SpoolDir}
+	for _, d := range []struct {
+		s string
+		d *time.Duration
+	}{{j.Backoff, &policy.Backoff}, {j.MaxBackoff, &policy.MaxBackoff}, {j.Timeout, &policy.Timeout}} {
+		if d.s == "" {
+			continue
+		}
+		*d.d, err = time.ParseDuration(d.s)
+		if err != nil {
+			return fmt.Errorf("Invalid retry policy duration: %w", err)
+		}
+	}
+	*p = policy
+	return nil
+}
+
+// WithRetry returns p retrying its calls after types.ErrTransient errors, with an exponential backoff
+// Calls are aborted after the policy's timeout without progress, the aborted call may finish in the background
+// Pushed assets are spooled to disk when they can't be read again nor regenerated, unless retries are disabled
+// Downloads are only retried if nothing was written yet
+// The returned provider implements the same optional interfaces as p
+func WithRetry(p types.Provider, policy RetryPolicy) types.Provider {
+	r := &retrier{p: p, policy: policy.withDefaults()}
+	m, isManager := p.(types.AssetManager)
+	h, isHistory := p.(types.VersionHistory)
+	w, isWatcher := p.(types.VersionWatcher)
+	rm := retryManager{r, m}
+	rh := retryHistory{r, h}
+	switch {
+	case isManager && isHistory && isWatcher:
+		return struct {
+			*retrier
+			retryManager
+			retryHistory
+			types.VersionWatcher
+		}{r, rm, rh, w}
+	case isManager && isHistory:
+		return struct {
+			*retrier
+			retryManager
+			retryHistory
+		}{r, rm, rh}
+	case isManager && isWatcher:
+		return struct {
+			*retrier
+			retryManager
+			types.VersionWatcher
+		}{r, rm, w}
+	case isHistory && isWatcher:
+		return struct {
+			*retrier
+			retryHistory
+			types.VersionWatcher
+		}{r, rh, w}
+	case isManager:
+		return struct {
+			*retrier
+			retryManager
+		}{r, rm}
+	case isHistory:
+		return struct {
+			*retrier
+			retryHistory
+		}{r, rh}
+	case isWatcher:
+		return struct {
+			*retrier
+			types.VersionWatcher
+		}{r, w}
+	}
+	return r
+}
+
+type retrier struct {
+	p      types.Provider
+	policy RetryPolicy
+}
+
+func (r *retrier) GetAsset(name string, writer io.Writer) error {
+	_, err := r.retry("getting asset "+name, func(s *stream) (interface{}, error) {
+		return nil, r.p.GetAsset(name, s.writer(writer))
+	}, func(s *stream) bool {
+		return !s.written()
+	})
+	return err
+}
+
+func (r *retrier) PushAsset(name string, reader io.Reader) error {
+	if r.policy.Attempts == 1 {
+		_, err := r.retry("pushing asset "+name, func(s *stream) (interface{}, error) {
+			return nil, r.p.PushAsset(name, s.reader(reader))
+		}, nil)
+		return err
+	}
+	if regenerable, ok := reader.(types.Regenerable); ok {
+		_, err := r.retry("pushing asset "+name, func(s *stream) (interface{}, error) {
+			source := io.Reader(regenerable)
+			if s.attempt > 1 {
+				var err error
+				source, err = regenerable.Regenerate()
+				if err != nil {
+					return nil, err
+				}
+			}
+			return nil, r.p.PushAsset(name, s.reader(source))
+		}, nil)
+		return err
+	}
+	source, size, clean, err := r.rereadable(reader)
+	if err != nil {
+		return err
+	}
+	defer clean()
+	_, err = r.retry("pushing asset "+name, func(s *stream) (interface{}, error) {
+		return nil, r.p.PushAsset(name, s.reader(io.NewSectionReader(source, 0, size)))
+	}, nil)
+	return err
+}
+
+func (r *retrier) GetCurrentVersion() (types.Version, error) {
+	v, err := r.retry("getting version", func(s *stream) (interface{}, error) {
+		return r.p.GetCurrentVersion()
+	}, nil)
+	if err != nil {
+		return types.Version{}, err
+	}
+	return v.(types.Version), nil
+}
+
+func (r *retrier) PushVersion(v types.Version) error {
+	_, err := r.retry("pushing version "+v.Name, func(s *stream) (interface{}, error) {
+		return nil, r.p.PushVersion(v)
+	}, nil)
+	return err
+}
+
+type retryManager struct {
+	r *retrier
+	m types.AssetManager
+}
+
+func (rm retryManager) ListAssets() ([]types.Asset, error) {
+	assets, err := rm.r.retry("listing assets", func(s *stream) (interface{}, error) {
+		return rm.m.ListAssets()
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return assets.([]types.Asset), nil
+}
+
+func (rm retryManager) DeleteAsset(name string) error {
+	_, err := rm.r.retry("deleting asset "+name, func(s *stream) (interface{}, error) {
+		err := rm.m.DeleteAsset(name)
+		// The previous attempt may have deleted it before failing
+		if s.attempt > 1 && errors.Is(err, types.ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}, nil)
+	return err
+}
+
+type retryHistory struct {
+	r *retrier
+	h types.VersionHistory
+}
+
+func (rh retryHistory) History() ([]types.Version, error) {
+	versions, err := rh.r.retry("getting history", func(s *stream) (interface{}, error) {
+		return rh.h.History()
+	}, nil)
+	if err != nil {
+		return nil, err
+	}
+	return versions.([]types.Version), nil
+}
+
+// retry calls f until it succeeds, fails with a non-transient error, runs out of attempts, or canRetry returns false
+func (r *retrier) retry(action string, f func(s *stream) (interface{}, error), canRetry func(s *stream) bool) (interface{}, error) {
+	backoff := r.policy.Backoff
+	for attempt := 1; ; attempt++ {
+		s := &stream{attempt: attempt, last: time.Now()}
+		result, err := r.attempt(s, f)
+		if err == nil || !errors.Is(err, types.ErrTransient) || attempt >= r.policy.Attempts ||
+			(canRetry != nil && !canRetry(s)) {
+			return result, err
+		}
+		log.Println("Error", action+":", err, "- retrying in", backoff)
+		time.Sleep(backoff)
+		backoff *= 2
+		if backoff > r.policy.MaxBackoff {
+			backoff = r.policy.MaxBackoff
+		}
+	}
+}
+
+// attempt calls f, aborting it if it doesn't make progress during the policy's timeout
+func (r *retrier) attempt(s *stream, f func(s *stream) (interface{}, error)) (interface{}, error) {
+	if r.policy.Timeout < 0 {
+		return f(s)
+	}
+	type result struct {
+		v   interface{}
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		v, err := f(s)
+		done <- result{v, err}
+	}()
+	interval := r.policy.Timeout / 10
+	if interval < time.Millisecond {
+		interval = time.Millisecond
+	}
+	check := time.NewTicker(interval)
+	defer check.Stop()
+	for {
+		select {
+		case res := <-done:
+			return res.v, res.err
+		case <-check.C:
+			if s.idle() > r.policy.Timeout {
+				s.abort()
+				return nil, types.WrapError(types.ErrTransient, fmt.Errorf("No progress in %s", r.policy.Timeout))
+			}
+		}
+	}
+}
+
+// rereadable returns a source from which reader's content can be read many times, spooling it to disk if needed
+func (r *retrier) rereadable(reader io.Reader) (io.ReaderAt, int64, func(), error) {
+	if sized, ok := reader.(interface {
+		io.ReaderAt
+		Size() int64
+	}); ok {
+		return sized, sized.Size(), func() {}, nil
+	}
+	spool, err := ioutil.TempFile(r.policy.SpoolDir, "dsd-spool-")
+	if err != nil {
+		return nil, 0, nil, err
+	}
+	clean := func() {
+		spool.Close()
+		os.Remove(spool.Name())
+	}
+	size, err := io.Copy(spool, reader)
+	if err != nil {
+		clean()
+		return nil, 0, nil, err
+	}
+	return spool, size, clean, nil
+}
+
+var errAborted = errors.New("Provider call aborted")
+
+// stream tracks the progress of an attempt, aborted attempts can't use its readers and writers anymore
+type stream struct {
+	attempt int
+
+	mutex   sync.Mutex
+	last    time.Time
+	n       int64
+	aborted bool
+}
+
+func (s *stream) idle() time.Duration {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return time.Since(s.last)
+}
+
+func (s *stream) written() bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.n > 0
+}
+
+func (s *stream) abort() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.aborted = true
+}
+
+func (s *stream) writer(w io.Writer) io.Writer {
+	return writerFunc(func(p []byte) (int, error) {
+		// The lock is held while writing, w isn't used after abort returns
+		s.mutex.Lock()
+		defer s.mutex.Unlock()
+		if s.aborted {
+			return 0, errAborted
+		}
+		n, err := w.Write(p)
+		s.n += int64(n)
+		s.last = time.Now()
+		return n, err
+	})
+}
+
+func (s *stream) reader(r io.Reader) io.Reader {
+	return readerFunc(func(p []byte) (int, error) {
+		s.mutex.Lock()
+		aborted := s.aborted
+		s.mutex.Unlock()
+		if aborted {
+			return 0, errAborted
+		}
+		n, err := r.Read(p)
+		s.mutex.Lock()
+		s.n += int64(n)
+		s.last = time.Now()
+		s.mutex.Unlock()
+		return n, err
+	})
+}
+
+type writerFunc func(p []byte) (int, error)
+
+func (f writerFunc) Write(p []byte) (int, error) { return f(p) }
+
+type readerFunc func(p []byte) (int, error)
+
+func (f readerFunc) Read(p []byte) (int, error) { return f(p) }
@@ -0,0 +1,229 @@
+package provider
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"io/ioutil"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/davidmanzanares/dsd/provider/memory"
+	"github.com/davidmanzanares/dsd/provider/providertest"
+	"github.com/davidmanzanares/dsd/types"
+)
+
+var testPolicy = RetryPolicy{Backoff: time.Millisecond, Timeout: 100 * time.Millisecond}
+
+// flakyProvider fails the first failures calls of every method with err
+// Failing pushes read part of their input first, and failing downloads write half of the asset if partial is set
+type flakyProvider struct {
+	*memory.Memory
+	failures int
+	err      error
+	partial  bool
+	// delay blocks the failing calls for this long before failing
+	delay time.Duration
+
+	mutex sync.Mutex
+	calls int
+}
+
+func (p *flakyProvider) fail() bool {
+	p.mutex.Lock()
+	p.calls++
+	failing := p.calls <= p.failures
+	p.mutex.Unlock()
+	if failing {
+		time.Sleep(p.delay)
+	}
+	return failing
+}
+
+func (p *flakyProvider) GetAsset(name string, writer io.Writer) error {
+	if p.fail() {
+		if p.partial {
+			var buff bytes.Buffer
+			p.Memory.GetAsset(name, &buff)
+			writer.Write(buff.Bytes()[:buff.Len()/2])
+		}
+		return p.err
+	}
+	return p.Memory.GetAsset(name, writer)
+}
+
+func (p *flakyProvider) PushAsset(name string, reader io.Reader) error {
+	if p.fail() {
+		reader.Read(make([]byte, 5))
+		return p.err
+	}
+	return p.Memory.PushAsset(name, reader)
+}
+
+func (p *flakyProvider) GetCurrentVersion() (types.Version, error) {
+	if p.fail() {
+		return types.Version{}, p.err
+	}
+	return p.Memory.GetCurrentVersion()
+}
+
+var errTransient = types.WrapError(types.ErrTransient, errors.New("Connection lost"))
+
+func TestRetryTransient(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 2, err: errTransient}
+	p := WithRetry(flaky, testPolicy)
+
+	// The reader can't be read again, it's spooled
+	err := p.PushAsset("a.tar.gz", ioutil.NopCloser(strings.NewReader("holamundo")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flaky.calls != 3 {
+		t.Fatal("Expected 3 calls, got", flaky.calls)
+	}
+	var buff bytes.Buffer
+	err = flaky.Memory.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "holamundo" {
+		t.Fatal(buff.String(), err)
+	}
+
+	flaky.calls = 0
+	buff.Reset()
+	err = p.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "holamundo" {
+		t.Fatal(buff.String(), err)
+	}
+
+	flaky.calls = 0
+	flaky.Memory.PushVersion(types.Version{Name: "a"})
+	v, err := p.GetCurrentVersion()
+	if err != nil || v.Name != "a" || flaky.calls != 3 {
+		t.Fatal(v, err, flaky.calls)
+	}
+}
+
+// regenerableReader reads content, counting its regenerations
+type regenerableReader struct {
+	io.Reader
+	content       string
+	regenerations *int
+}
+
+func (r regenerableReader) Regenerate() (io.Reader, error) {
+	*r.regenerations++
+	return regenerableReader{strings.NewReader(r.content), r.content, r.regenerations}, nil
+}
+
+func TestRetryRegenerable(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 2, err: errTransient}
+	policy := testPolicy
+	// Spooling fails, regenerable readers aren't spooled
+	policy.SpoolDir = "/nonexistent/dsd-spool"
+	p := WithRetry(flaky, policy)
+
+	var regenerations int
+	err := p.PushAsset("a.tar.gz", regenerableReader{strings.NewReader("holamundo"), "holamundo", &regenerations})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if flaky.calls != 3 || regenerations != 2 {
+		t.Fatal("Expected 3 calls and 2 regenerations, got", flaky.calls, regenerations)
+	}
+	var buff bytes.Buffer
+	err = flaky.Memory.GetAsset("a.tar.gz", &buff)
+	if err != nil || buff.String() != "holamundo" {
+		t.Fatal(buff.String(), err)
+	}
+}
+
+func TestRetryAttempts(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 10, err: errTransient}
+	policy := testPolicy
+	policy.Attempts = 3
+	_, err := WithRetry(flaky, policy).GetCurrentVersion()
+	if !errors.Is(err, types.ErrTransient) || flaky.calls != 3 {
+		t.Fatal("Expected 3 failed calls, got", flaky.calls, err)
+	}
+
+	flaky.calls = 0
+	policy.Attempts = -1
+	_, err = WithRetry(flaky, policy).GetCurrentVersion()
+	if !errors.Is(err, types.ErrTransient) || flaky.calls != 1 {
+		t.Fatal("Expected 1 failed call, got", flaky.calls, err)
+	}
+}
+
+func TestRetryPermanentErrors(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 10, err: types.ErrUnauthorized}
+	_, err := WithRetry(flaky, testPolicy).GetCurrentVersion()
+	if !errors.Is(err, types.ErrUnauthorized) || flaky.calls != 1 {
+		t.Fatal("Expected 1 failed call, got", flaky.calls, err)
+	}
+}
+
+func TestRetryPartialDownload(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 1, err: errTransient, partial: true}
+	flaky.Memory.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	var buff bytes.Buffer
+	err := WithRetry(flaky, testPolicy).GetAsset("a.tar.gz", &buff)
+	if !errors.Is(err, types.ErrTransient) || flaky.calls != 1 {
+		t.Fatal("Partial downloads can't be retried", flaky.calls, err)
+	}
+}
+
+func TestRetryTimeout(t *testing.T) {
+	flaky := &flakyProvider{Memory: memory.New(), failures: 1, err: errors.New("Too late"), delay: time.Second}
+	flaky.Memory.PushVersion(types.Version{Name: "a"})
+	start := time.Now()
+	v, err := WithRetry(flaky, testPolicy).GetCurrentVersion()
+	if err != nil || v.Name != "a" {
+		t.Fatal(v, err)
+	}
+	if time.Since(start) > flaky.delay/2 {
+		t.Fatal("The first call wasn't aborted")
+	}
+}
+
+func TestRetryInterfaces(t *testing.T) {
+	p := WithRetry(memory.New(), testPolicy)
+	if _, ok := p.(types.AssetManager); !ok {
+		t.Fatal("types.AssetManager not kept")
+	}
+	if _, ok := p.(types.VersionHistory); !ok {
+		t.Fatal("types.VersionHistory not kept")
+	}
+	if _, ok := p.(types.VersionWatcher); ok {
+		t.Fatal("types.VersionWatcher added")
+	}
+}
+
+func TestRetryConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) types.Provider {
+		return WithRetry(memory.New(), RetryPolicy{Backoff: time.Millisecond})
+	})
+}
+
+func TestRetryPolicyJSON(t *testing.T) {
+	var policy RetryPolicy
+	err := json.Unmarshal([]byte(`{"Attempts": 5, "Backoff": "2s", "Timeout": "1m"}`), &policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.Attempts != 5 || policy.Backoff != 2*time.Second || policy.Timeout != time.Minute || policy.MaxBackoff != 0 {
+		t.Fatal(policy)
+	}
+	b, err := json.Marshal(policy)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != `{"Attempts":5,"Backoff":"2s","Timeout":"1m0s"}` {
+		t.Fatal(string(b))
+	}
+	err = json.Unmarshal([]byte(`{"Backoff": "wadus"}`), &policy)
+	if err == nil {
+		t.Fatal("Expected invalid duration error")
+	}
+}
@@ -6,30 +6,69 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net/url"
+	"strconv"
 	"strings"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"github.com/davidmanzanares/dsd/internal/fileio"
 	"github.com/davidmanzanares/dsd/types"
 )
 
 type S3 struct {
-	path   string
-	region string
+	path    string
+	options options
+	sess    *session.Session
+}
+
+// options are set with the query parameters of the service URL, for example:
+// s3://bucket/dev?endpoint=http://localhost:9000&path-style=true&access-key-id=minio&secret-access-key=minio123
+type options struct {
+	endpoint        string
+	pathStyle       bool
+	region          string
+	profile         string
+	accessKeyID     string
+	secretAccessKey string
+	sessionToken    string
+	storageClass    string
+	sse             string
+	sseKMSKeyID     string
 }
 
 func Create(service string) (types.Provider, error) {
+	service, query := splitQuery(service)
 	bucket, _, err := parseURL(service)
 	if err != nil {
 		return nil, err
 	}
-	region, err := s3manager.GetBucketRegion(context.Background(), session.Must(session.NewSession()), bucket, "")
+	opts, err := parseOptions(query)
+	if err != nil {
+		return nil, err
+	}
+	sess, err := opts.session()
 	if err != nil {
 		return nil, err
 	}
-	return &S3{path: service, region: region}, nil
+	if opts.region == "" {
+		if opts.endpoint != "" {
+			// S3-compatible stores don't support GetBucketRegion, they usually ignore the region
+			opts.region = "us-east-1"
+		} else {
+			opts.region, err = s3manager.GetBucketRegion(context.Background(), sess, bucket, "")
+			if err != nil {
+				return nil, wrapError(err)
+			}
+		}
+		sess = sess.Copy(&aws.Config{Region: aws.String(opts.region)})
+	}
+	return &S3{path: service, options: opts, sess: sess}, nil
 }
 
 func (s *S3) GetAsset(name string, writer io.Writer) error {
@@ -44,7 +83,7 @@ func (s *S3) GetCurrentVersion() (types.Version, error) {
 	buffer := bytes.NewBuffer(nil)
 	err := s.get("/VERSION", buffer)
 	if err != nil {
-		return types.Version{}, fmt.Errorf("S3 error getting version: %s", err.Error())
+		return types.Version{}, fmt.Errorf("S3 error getting version: %w", err)
 	}
 	v, err := types.DeserializeVersion(buffer.Bytes())
 	if err != nil {
@@ -61,27 +100,65 @@ func (s *S3) PushVersion(v types.Version) error {
 	return s.push("/VERSION", bytes.NewReader(buff))
 }
 
-func (s *S3) get(path string, writer io.Writer) error {
-	bucket, key, err := parseURL(s.path + path)
+// ListAssets lists every asset stored under the service's assets folder
+func (s *S3) ListAssets() ([]types.Asset, error) {
+	bucket, prefix, err := parseURL(s.path + "/assets/")
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	sess, _ := session.NewSession(&aws.Config{Region: aws.String(s.region)})
+	var assets []types.Asset
+	err = s3.New(s.sess).ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bucket),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			assets = append(assets, types.Asset{
+				Name: strings.TrimPrefix(aws.StringValue(obj.Key), prefix),
+				Size: aws.Int64Value(obj.Size),
+				Time: aws.TimeValue(obj.LastModified),
+			})
+		}
+		return true
+	})
+	if err != nil {
+		return nil, wrapError(err)
+	}
+	return assets, nil
+}
 
-	downloader := s3manager.NewDownloader(sess)
+// DeleteAsset removes the asset name from the service
+func (s *S3) DeleteAsset(name string) error {
+	bucket, key, err := parseURL(s.path + "/assets/" + name)
+	if err != nil {
+		return err
+	}
 
-	buff := &aws.WriteAtBuffer{}
-	_, err = downloader.Download(buff, &s3.GetObjectInput{
+	_, err = s3.New(s.sess).DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 	})
+	return wrapError(err)
+}
+
+// get streams the object at path into writer, memory usage doesn't depend on the object size
+func (s *S3) get(path string, writer io.Writer) error {
+	bucket, key, err := parseURL(s.path + path)
 	if err != nil {
 		return err
 	}
-	writer.Write(buff.Bytes())
 
-	return nil
+	out, err := s3.New(s.sess).GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return wrapError(err)
+	}
+	defer out.Body.Close()
+
+	_, err = io.Copy(writer, fileio.TransientReader{R: out.Body})
+	return err
 }
 
 func (s *S3) push(name string, reader io.Reader) error {
@@ -90,22 +167,132 @@ func (s *S3) push(name string, reader io.Reader) error {
 		return err
 	}
 
-	sess, _ := session.NewSession(&aws.Config{Region: aws.String(s.region)})
-
-	uploader := s3manager.NewUploader(sess)
+	uploader := s3manager.NewUploader(s.sess)
 
-	_, err = uploader.Upload(&s3manager.UploadInput{
+	input := &s3manager.UploadInput{
 		Bucket: aws.String(bucket),
 		Key:    aws.String(key),
 		Body:   reader,
-	})
+	}
+	if s.options.storageClass != "" {
+		input.StorageClass = aws.String(s.options.storageClass)
+	}
+	if s.options.sse != "" {
+		input.ServerSideEncryption = aws.String(s.options.sse)
+	}
+	if s.options.sseKMSKeyID != "" {
+		input.SSEKMSKeyId = aws.String(s.options.sseKMSKeyID)
+	}
+	_, err = uploader.Upload(input)
 	if err != nil {
+		return wrapError(err)
+	}
+
+	return nil
+}
+
+// wrapError marks err with the types error matching its AWS error code
+func wrapError(err error) error {
+	var aerr awserr.Error
+	if !errors.As(err, &aerr) {
 		return err
 	}
+	if kind := errorKind(aerr); kind != nil {
+		return types.WrapError(kind, err)
+	}
+	return err
+}
 
+func errorKind(aerr awserr.Error) error {
+	switch aerr.Code() {
+	case s3.ErrCodeNoSuchKey, s3.ErrCodeNoSuchBucket, "NotFound":
+		return types.ErrNotFound
+	case "AccessDenied", "Forbidden", "InvalidAccessKeyId", "SignatureDoesNotMatch", "ExpiredToken",
+		"InvalidToken", "NoCredentialProviders":
+		return types.ErrUnauthorized
+	case request.ErrCodeRequestError, request.ErrCodeRead, request.ErrCodeResponseTimeout,
+		"RequestTimeout", "SlowDown", "Throttling", "ThrottlingException", "InternalError", "ServiceUnavailable":
+		return types.ErrTransient
+	}
+	if rerr, ok := aerr.(awserr.RequestFailure); ok && rerr.StatusCode() >= 500 {
+		return types.ErrTransient
+	}
+	// Multipart upload errors wrap the error of the failed request
+	if orig, ok := aerr.OrigErr().(awserr.Error); ok {
+		return errorKind(orig)
+	}
 	return nil
 }
 
+func (o options) session() (*session.Session, error) {
+	config := aws.Config{S3ForcePathStyle: aws.Bool(o.pathStyle)}
+	if o.endpoint != "" {
+		config.Endpoint = aws.String(o.endpoint)
+	}
+	if o.region != "" {
+		config.Region = aws.String(o.region)
+	}
+	if o.accessKeyID != "" {
+		config.Credentials = credentials.NewStaticCredentials(o.accessKeyID, o.secretAccessKey, o.sessionToken)
+	}
+	sessionOptions := session.Options{Config: config, Profile: o.profile}
+	if o.profile != "" {
+		sessionOptions.SharedConfigState = session.SharedConfigEnable
+	}
+	return session.NewSessionWithOptions(sessionOptions)
+}
+
+func parseOptions(query string) (options, error) {
+	var o options
+	values, err := url.ParseQuery(query)
+	if err != nil {
+		return o, err
+	}
+	for k, v := range values {
+		value := v[len(v)-1]
+		switch k {
+		case "endpoint":
+			o.endpoint = value
+		case "path-style":
+			o.pathStyle, err = strconv.ParseBool(value)
+			if err != nil {
+				return o, fmt.Errorf("Invalid S3 path-style option: %s", value)
+			}
+		case "region":
+			o.region = value
+		case "profile":
+			o.profile = value
+		case "access-key-id":
+			o.accessKeyID = value
+		case "secret-access-key":
+			o.secretAccessKey = value
+		case "session-token":
+			o.sessionToken = value
+		case "storage-class":
+			o.storageClass = value
+		case "sse":
+			o.sse = value
+		case "sse-kms-key-id":
+			o.sseKMSKeyID = value
+		default:
+			return o, fmt.Errorf("Unknown S3 option: %s", k)
+		}
+	}
+	if (o.accessKeyID == "") != (o.secretAccessKey == "") {
+		return o, errors.New("S3 options access-key-id and secret-access-key must be set together")
+	}
+	return o, nil
+}
+
+// splitQuery splits the service URL on its query string
+func splitQuery(service string) (string, string) {
+	parts := strings.SplitN(service, "?", 2)
+	if len(parts) == 1 {
+		return parts[0], ""
+	}
+	return parts[0], parts[1]
+}
+
 var errInvalidURL error = errors.New("S3 service must begin with s3://")
 
 func parseURL(s string) (bucket string, key string, err error) {
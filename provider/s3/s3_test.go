@@ -3,17 +3,25 @@ package s3
 import (
 	"bytes"
 	"crypto/rand"
+	"crypto/sha256"
 	"encoding/base64"
 	"encoding/hex"
+	"errors"
+	"io"
+	"os"
 	"strings"
 	"testing"
 	"time"
 
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/davidmanzanares/dsd/provider/providertest"
 	"github.com/davidmanzanares/dsd/types"
 )
 
 func TestAsset(t *testing.T) {
-	s, err := Create("s3://dsd-s3-test/" + base64.RawURLEncoding.EncodeToString(uid()))
+	s, err := Create(testService(t, base64.RawURLEncoding.EncodeToString(uid())))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -32,8 +40,61 @@ func TestAsset(t *testing.T) {
 	}
 }
 
+func TestLargeAsset(t *testing.T) {
+	s, err := Create(testService(t, hex.EncodeToString(uid())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	const size = 32 << 20
+	pushHash := sha256.New()
+	err = s.PushAsset("large", io.TeeReader(io.LimitReader(rand.Reader, size), pushHash))
+	if err != nil {
+		t.Fatal(err)
+	}
+	getHash := sha256.New()
+	err = s.GetAsset("large", getHash)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(pushHash.Sum(nil), getHash.Sum(nil)) {
+		t.Fatal("Downloaded asset differs from the uploaded one")
+	}
+}
+
+func TestListDeleteAssets(t *testing.T) {
+	s, err := Create(testService(t, hex.EncodeToString(uid())))
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := s.(types.AssetManager)
+
+	err = s.PushAsset("a.tar.gz", strings.NewReader("holamundo"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	assets, err := m.ListAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 1 || assets[0].Name != "a.tar.gz" || assets[0].Size != int64(len("holamundo")) {
+		t.Fatal(assets)
+	}
+
+	err = m.DeleteAsset("a.tar.gz")
+	if err != nil {
+		t.Fatal(err)
+	}
+	assets, err = m.ListAssets()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(assets) != 0 {
+		t.Fatal(assets)
+	}
+}
+
 func TestVersion(t *testing.T) {
-	s, err := Create("s3://dsd-s3-test/" + hex.EncodeToString(uid()))
+	s, err := Create(testService(t, hex.EncodeToString(uid())))
 	if err != nil {
 		t.Fatal(err)
 	}
@@ -53,12 +114,73 @@ func TestVersion(t *testing.T) {
 }
 
 func TestAccessError(t *testing.T) {
+	testService(t, "")
 	_, err := Create("s3://dsd-s3-test-INVALID-BUCKET" + hex.EncodeToString(uid()))
 	if err == nil {
 		t.Fatal("No Access error")
 	}
 }
 
+func TestParseOptions(t *testing.T) {
+	o, err := parseOptions("endpoint=http://localhost:9000&path-style=true&region=eu-west-1&profile=dev" +
+		"&access-key-id=id&secret-access-key=secret&storage-class=STANDARD_IA&sse=aws:kms&sse-kms-key-id=key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := options{endpoint: "http://localhost:9000", pathStyle: true, region: "eu-west-1", profile: "dev",
+		accessKeyID: "id", secretAccessKey: "secret", storageClass: "STANDARD_IA", sse: "aws:kms", sseKMSKeyID: "key"}
+	if o != expected {
+		t.Fatal(o)
+	}
+	_, err = parseOptions("wadus=1")
+	if err == nil {
+		t.Fatal("Expected unknown option error")
+	}
+	_, err = parseOptions("access-key-id=id")
+	if err == nil {
+		t.Fatal("Expected missing secret error")
+	}
+}
+
+func TestWrapError(t *testing.T) {
+	cases := []struct {
+		err  error
+		kind error
+	}{
+		{awserr.New(s3.ErrCodeNoSuchKey, "The specified key does not exist.", nil), types.ErrNotFound},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "Access Denied", nil), 403, "id"), types.ErrUnauthorized},
+		{awserr.New(request.ErrCodeRequestError, "send request failed", errors.New("connection reset")), types.ErrTransient},
+		{awserr.NewRequestFailure(awserr.New("Wadus", "Wadus", nil), 502, "id"), types.ErrTransient},
+		{awserr.New("MultipartUpload", "upload multipart failed", awserr.New("SlowDown", "Slow Down", nil)), types.ErrTransient},
+	}
+	for _, c := range cases {
+		err := wrapError(c.err)
+		if !errors.Is(err, c.kind) {
+			t.Error(c.err, "expected to be", c.kind)
+		}
+		if err.Error() != c.err.Error() {
+			t.Error(err.Error())
+		}
+	}
+	err := wrapError(awserr.New("InvalidArgument", "Invalid Argument", nil))
+	for _, kind := range []error{types.ErrNotFound, types.ErrUnauthorized, types.ErrTransient} {
+		if errors.Is(err, kind) {
+			t.Error(err, "unexpectedly is", kind)
+		}
+	}
+}
+
+func TestSplitQuery(t *testing.T) {
+	service, query := splitQuery("s3://bucket/folder?region=eu-west-1")
+	if service != "s3://bucket/folder" || query != "region=eu-west-1" {
+		t.Fatal(service, query)
+	}
+	service, query = splitQuery("s3://bucket/folder")
+	if service != "s3://bucket/folder" || query != "" {
+		t.Fatal(service, query)
+	}
+}
+
 func TestParseURL1(t *testing.T) {
 	testParseURL("s3://bucket", "bucket", "", nil, t)
 	testParseURL("s3://bucket/", "bucket", "", nil, t)
@@ -86,8 +208,34 @@ func testParseURL(url, expectedBucket, expectedKey string, expectedError error,
 	}
 }
 
+// testService returns a service URL for key inside the test bucket set by DSD_S3_TEST_SERVICE
+// Tests that need S3 are skipped if it isn't set, it also allows to run them against S3-compatible stores like MinIO:
+// DSD_S3_TEST_SERVICE="s3://test?endpoint=http://localhost:9000&path-style=true&access-key-id=minio&secret-access-key=minio123"
+func testService(t *testing.T, key string) string {
+	service := os.Getenv("DSD_S3_TEST_SERVICE")
+	if service == "" {
+		t.Skip("DSD_S3_TEST_SERVICE not set")
+	}
+	service, query := splitQuery(service)
+	service = strings.TrimSuffix(service, "/") + "/" + key
+	if query != "" {
+		service += "?" + query
+	}
+	return service
+}
+
 func uid() []byte {
 	buff := make([]byte, 6)
 	rand.Read(buff)
 	return buff
 }
+
+func TestConformance(t *testing.T) {
+	providertest.Run(t, func(t *testing.T) types.Provider {
+		s, err := Create(testService(t, hex.EncodeToString(uid())))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	})
+}
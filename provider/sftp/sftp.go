@@ -0,0 +1,414 @@
+package sftp
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/davidmanzanares/dsd/internal/fileio"
+	"github.com/davidmanzanares/dsd/types"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// SFTP stores the VERSION/assets layout in a remote folder accessed through SFTP
+type SFTP struct {
+	path   string
+	addr   string
+	config *ssh.ClientConfig
+	// signers are the keys read by Create, the keys of the SSH agent listening on agentSock are added on every connection
+	signers   []ssh.Signer
+	agentSock string
+
+	// The connection is established on the first use, and again after connection errors
+	// The mutex only guards the connection, the transfers share the client concurrently
+	mutex  sync.Mutex
+	conn   *ssh.Client
+	client *sftp.Client
+	agent  net.Conn
+}
+
+// Create returns an SFTP provider for service, like sftp://user@host:port/path
+// Paths starting with /~/ are relative to the user's home folder
+// Options are set with query parameters:
+//
+//	key: private key file, it can be repeated, by default the keys in ~/.ssh are used
+//	known-hosts: known_hosts file used to verify the server, ~/.ssh/known_hosts by default
+//
+// The SSH agent is used if SSH_AUTH_SOCK is set
+func Create(service string) (types.Provider, error) {
+	u, err := url.Parse(service)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "sftp" {
+		return nil, errors.New("SFTP service must begin with sftp://")
+	}
+	if _, ok := u.User.Password(); ok {
+		return nil, errors.New("SFTP passwords aren't supported, use keys or an SSH agent")
+	}
+	options, err := url.ParseQuery(u.RawQuery)
+	if err != nil {
+		return nil, err
+	}
+	home, _ := os.UserHomeDir()
+
+	var signers []ssh.Signer
+	keys := options["key"]
+	knownHostsFiles := options["known-hosts"]
+	for k := range options {
+		if k != "key" && k != "known-hosts" {
+			return nil, fmt.Errorf("Unknown SFTP option: %s", k)
+		}
+	}
+	if len(keys) == 0 {
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			if _, err := os.Stat(filepath.Join(home, ".ssh", name)); err == nil {
+				keys = append(keys, filepath.Join(home, ".ssh", name))
+			}
+		}
+	}
+	for _, k := range keys {
+		pem, err := ioutil.ReadFile(k)
+		if err != nil {
+			return nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(pem)
+		if err != nil {
+			return nil, fmt.Errorf("Error parsing SSH key %s: %s", k, err.Error())
+		}
+		signers = append(signers, signer)
+	}
+	agentSock := os.Getenv("SSH_AUTH_SOCK")
+	if len(signers) == 0 && agentSock == "" {
+		return nil, errNoKeys
+	}
+
+	if len(knownHostsFiles) == 0 {
+		knownHostsFiles = []string{filepath.Join(home, ".ssh", "known_hosts")}
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFiles...)
+	if err != nil {
+		return nil, err
+	}
+
+	username := u.User.Username()
+	if username == "" {
+		username = os.Getenv("USER")
+	}
+	addr := u.Host
+	if u.Port() == "" {
+		addr = net.JoinHostPort(u.Hostname(), "22")
+	}
+	p := strings.TrimSuffix(u.Path, "/")
+	if strings.HasPrefix(p, "/~/") {
+		p = p[len("/~/"):]
+	} else if p == "/~" || p == "" {
+		p = "."
+	}
+
+	return &SFTP{
+		path: p,
+		addr: addr,
+		config: &ssh.ClientConfig{
+			User:            username,
+			HostKeyCallback: hostKeyCallback,
+		},
+		signers:   signers,
+		agentSock: agentSock,
+	}, nil
+}
+
+var errNoKeys = errors.New("No SSH keys found, set the key option or use an SSH agent")
+
+func (s *SFTP) GetAsset(name string, writer io.Writer) error {
+	filename, err := s.assetPath(name)
+	if err != nil {
+		return err
+	}
+	return s.do(func(client *sftp.Client) error {
+		f, err := client.Open(filename)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("SFTP asset %s: %w", name, types.ErrNotFound)
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(callerWriter{writer}, f)
+		return err
+	})
+}
+
+func (s *SFTP) PushAsset(name string, reader io.Reader) error {
+	filename, err := s.assetPath(name)
+	if err != nil {
+		return err
+	}
+	return s.do(func(client *sftp.Client) error {
+		return fileio.WriteAtomic(sftpFS{client}, filename, callerReader{reader})
+	})
+}
+
+func (s *SFTP) GetCurrentVersion() (types.Version, error) {
+	var buffer bytes.Buffer
+	err := s.do(func(client *sftp.Client) error {
+		f, err := client.Open(path.Join(s.path, "VERSION"))
+		if os.IsNotExist(err) {
+			return types.ErrNotFound
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		_, err = io.Copy(&buffer, f)
+		return err
+	})
+	if err != nil {
+		return types.Version{}, fmt.Errorf("SFTP error getting version: %w", err)
+	}
+	v, err := types.DeserializeVersion(buffer.Bytes())
+	if err != nil {
+		return v, fmt.Errorf("Error %s\nVERSION file contains: \"%s\"\n", err.Error(), buffer.String())
+	}
+	return v, nil
+}
+
+// PushVersion writes the VERSION file atomically, runners never read partially written versions
+func (s *SFTP) PushVersion(v types.Version) error {
+	buff, err := v.Serialize()
+	if err != nil {
+		return err
+	}
+	return s.do(func(client *sftp.Client) error {
+		return fileio.WriteAtomic(sftpFS{client}, path.Join(s.path, "VERSION"), bytes.NewReader(buff))
+	})
+}
+
+// ListAssets lists every asset stored under the service's assets folder
+func (s *SFTP) ListAssets() ([]types.Asset, error) {
+	folder := path.Join(s.path, "assets")
+	var assets []types.Asset
+	err := s.do(func(client *sftp.Client) error {
+		assets = nil
+		walker := client.Walk(folder)
+		for walker.Step() {
+			if err := walker.Err(); err != nil {
+				if walker.Path() == folder && os.IsNotExist(err) {
+					return nil
+				}
+				return err
+			}
+			fi := walker.Stat()
+			if fi.IsDir() || strings.HasPrefix(fi.Name(), fileio.TmpPrefix) {
+				continue
+			}
+			assets = append(assets, types.Asset{
+				Name: strings.TrimPrefix(walker.Path(), folder+"/"),
+				Size: fi.Size(),
+				Time: fi.ModTime(),
+			})
+		}
+		return nil
+	})
+	return assets, err
+}
+
+// DeleteAsset removes the asset name from the service
+func (s *SFTP) DeleteAsset(name string) error {
+	filename, err := s.assetPath(name)
+	if err != nil {
+		return err
+	}
+	return s.do(func(client *sftp.Client) error {
+		err := client.Remove(filename)
+		if os.IsNotExist(err) {
+			return fmt.Errorf("SFTP asset %s: %w", name, types.ErrNotFound)
+		}
+		return err
+	})
+}
+
+// do runs f with a connected client, connecting if needed
+// Connection errors close the client, the next call will connect again
+// The errors of the caller's readers and writers are returned unchanged, they aren't connection errors
+func (s *SFTP) do(f func(client *sftp.Client) error) error {
+	client, err := s.connect()
+	if err != nil {
+		return err
+	}
+	err = f(client)
+	var callerErr callerError
+	if errors.As(err, &callerErr) {
+		return callerErr.err
+	}
+	if err != nil && !isStatusError(err) {
+		s.disconnect(client)
+		return types.WrapError(types.ErrTransient, err)
+	}
+	if errors.Is(err, os.ErrPermission) {
+		return types.WrapError(types.ErrUnauthorized, err)
+	}
+	return err
+}
+
+// connect returns the connected client, connecting if needed
+// The connection to the SSH agent stays open until the client is closed
+func (s *SFTP) connect() (*sftp.Client, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != nil {
+		return s.client, nil
+	}
+	signers := s.signers
+	var agentConn net.Conn
+	if s.agentSock != "" {
+		if conn, err := net.Dial("unix", s.agentSock); err == nil {
+			agentSigners, err := agent.NewClient(conn).Signers()
+			if err == nil {
+				signers = append(signers[:len(signers):len(signers)], agentSigners...)
+				agentConn = conn
+			} else {
+				conn.Close()
+			}
+		}
+	}
+	if len(signers) == 0 {
+		return nil, errNoKeys
+	}
+	config := *s.config
+	config.Auth = []ssh.AuthMethod{ssh.PublicKeys(signers...)}
+	conn, err := ssh.Dial("tcp", s.addr, &config)
+	if err != nil {
+		closeAgent(agentConn)
+		return nil, dialError(err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		closeAgent(agentConn)
+		return nil, types.WrapError(types.ErrTransient, err)
+	}
+	s.conn = conn
+	s.client = client
+	s.agent = agentConn
+	return client, nil
+}
+
+// disconnect closes client after a connection error, unless a concurrent call already replaced it
+func (s *SFTP) disconnect(client *sftp.Client) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.client != client {
+		return
+	}
+	s.client.Close()
+	s.conn.Close()
+	closeAgent(s.agent)
+	s.client = nil
+	s.conn = nil
+	s.agent = nil
+}
+
+func closeAgent(conn net.Conn) {
+	if conn != nil {
+		conn.Close()
+	}
+}
+
+// dialError marks the errors connecting to the server with the matching types error
+// Host key mismatches aren't marked, retrying them can't succeed
+func dialError(err error) error {
+	var netErr net.Error
+	if strings.Contains(err.Error(), "unable to authenticate") {
+		return types.WrapError(types.ErrUnauthorized, err)
+	}
+	if errors.As(err, &netErr) {
+		return types.WrapError(types.ErrTransient, err)
+	}
+	return err
+}
+
+// callerError marks the errors of the readers and writers passed by the caller
+type callerError struct {
+	err error
+}
+
+func (e callerError) Error() string {
+	return e.err.Error()
+}
+
+func (e callerError) Unwrap() error {
+	return e.err
+}
+
+type callerReader struct {
+	r io.Reader
+}
+
+func (c callerReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	if err != nil && err != io.EOF {
+		err = callerError{err}
+	}
+	return n, err
+}
+
+type callerWriter struct {
+	w io.Writer
+}
+
+func (c callerWriter) Write(p []byte) (int, error) {
+	n, err := c.w.Write(p)
+	if err != nil {
+		err = callerError{err}
+	}
+	return n, err
+}
+
+func isStatusError(err error) bool {
+	var statusErr *sftp.StatusError
+	return errors.Is(err, types.ErrNotFound) || errors.Is(err, os.ErrNotExist) || errors.Is(err, os.ErrPermission) ||
+		errors.As(err, &statusErr)
+}
+
+// assetPath returns the path of the asset name, rejecting names outside the assets folder
+func (s *SFTP) assetPath(name string) (string, error) {
+	err := fileio.CheckAssetName(name)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(s.path, "assets", name), nil
+}
+
+// sftpFS is the remote file system of client
+type sftpFS struct {
+	client *sftp.Client
+}
+
+func (fs sftpFS) MkdirAll(dir string) error {
+	return fs.client.MkdirAll(dir)
+}
+
+func (fs sftpFS) Create(name string) (io.WriteCloser, error) {
+	return fs.client.Create(name)
+}
+
+func (fs sftpFS) Rename(from, to string) error {
+	return fs.client.PosixRename(from, to)
+}
+
+func (fs sftpFS) Remove(name string) error {
+	return fs.client.Remove(name)
+}
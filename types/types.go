@@ -2,6 +2,8 @@ package types
 
 import (
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"time"
 )
@@ -16,10 +18,132 @@ type Provider interface {
 	GetCurrentVersion() (Version, error)
 }
 
+// Errors returned by providers and dsdl, usually wrapped, they must be checked with errors.Is
+var (
+	// ErrNotFound is returned when an asset or the VERSION file doesn't exist, like when nothing has been deployed yet
+	ErrNotFound = errors.New("not found")
+	// ErrUnauthorized is returned when the service rejects the credentials
+	ErrUnauthorized = errors.New("unauthorized")
+	// ErrTransient is returned by failures which may succeed if retried, like network errors or timeouts
+	ErrTransient = errors.New("transient error")
+	// ErrNoExecutable is returned when a deployment doesn't contain any executable file
+	ErrNoExecutable = errors.New("no executable")
+	// ErrUnsupportedVersion is returned when a deployment can't be run by this runner, like with unknown codecs or
+	// without an archive for its platform
+	ErrUnsupportedVersion = errors.New("unsupported version")
+	// ErrUnknownScheme is returned for services not handled by any provider
+	ErrUnknownScheme = errors.New("unknown service scheme")
+)
+
+// WrapError returns err marked as kind, errors.Is matches both kind and the errors wrapped by err
+// It returns nil if err is nil
+func WrapError(kind error, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &wrappedError{kind: kind, err: err}
+}
+
+type wrappedError struct {
+	kind error
+	err  error
+}
+
+func (e *wrappedError) Error() string {
+	return e.err.Error()
+}
+
+func (e *wrappedError) Unwrap() error {
+	return e.err
+}
+
+func (e *wrappedError) Is(target error) bool {
+	return target == e.kind
+}
+
+// Asset describes an asset stored on a provider
+type Asset struct {
+	Name string
+	Size int64
+	Time time.Time
+}
+
+// AssetManager is implemented by providers which can list and delete their stored assets
+type AssetManager interface {
+	ListAssets() ([]Asset, error)
+	DeleteAsset(name string) error
+}
+
+// VersionWatcher is implemented by providers which can notify version changes without polling
+type VersionWatcher interface {
+	// WatchVersions sends every new version until stop is closed
+	// The returned channel is closed when stop is closed or if watching isn't possible
+	WatchVersions(stop <-chan struct{}) <-chan Version
+}
+
+// VersionHistory is implemented by providers which keep the history of the pushed versions
+type VersionHistory interface {
+	// History returns the pushed versions, newest first
+	History() ([]Version, error)
+}
+
+// Regenerable is implemented by the readers passed to PushAsset which can produce their content again
+// Retrying providers push a regenerated reader instead of keeping a copy of the content
+type Regenerable interface {
+	io.Reader
+	// Regenerate returns a reader with the whole content, the readers returned before can't be used anymore
+	Regenerate() (io.Reader, error)
+}
+
 // Version is composed of a unique name (identifier) and a timestamp
+// The other fields describe the deploy, they are empty on versions deployed by older releases
 type Version struct {
 	Name string
 	Time time.Time
+
+	// User and Hostname identify who deployed the version
+	User     string `json:",omitempty"`
+	Hostname string `json:",omitempty"`
+	// Git describes the checkout the version was deployed from
+	Git     *GitInfo `json:",omitempty"`
+	Message string   `json:",omitempty"`
+	// Entrypoint is the slash separated path of the program to run inside the archive
+	// The first executable of the archive is run if it's empty
+	Entrypoint string `json:",omitempty"`
+	// Codec is the compression of the archives: "gzip", "zstd" or "none", versions without it are gzipped
+	Codec string `json:",omitempty"`
+	// Blobs is set if the archives are manifests of content-addressed blobs, instead of tar archives
+	Blobs bool `json:",omitempty"`
+	// Size is the size of the archive in bytes, Files the number of files in it
+	// Blob versions only count the bytes they uploaded, the blobs stored by previous versions aren't counted
+	Size  int64 `json:",omitempty"`
+	Files int   `json:",omitempty"`
+	// Meta holds free-form metadata
+	Meta map[string]string `json:",omitempty"`
+	// Platforms has the archives of multi-platform versions, by "GOOS/GOARCH" or "GOOS" platform
+	// Other versions have a single archive, named after the version
+	Platforms map[string]Artifact `json:",omitempty"`
+}
+
+// Artifact is the archive of a multi-platform version for one platform
+type Artifact struct {
+	Asset      string
+	Entrypoint string `json:",omitempty"`
+	Size       int64  `json:",omitempty"`
+	Files      int    `json:",omitempty"`
+}
+
+// GitInfo describes a git checkout
+type GitInfo struct {
+	Commit string
+	Branch string `json:",omitempty"`
+	// Dirty is set if the checkout had uncommitted changes
+	Dirty bool `json:",omitempty"`
+}
+
+// String formats the name and the time of v, the metadata is left out
+func (v Version) String() string {
+	return fmt.Sprintf("{%s %s}", v.Name, v.Time)
 }
 
 // Serialize marshals v
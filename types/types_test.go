@@ -1,6 +1,8 @@
 package types
 
 import (
+	"errors"
+	"fmt"
 	"testing"
 	"time"
 )
@@ -22,3 +24,44 @@ func TestVersionSerialization(t *testing.T) {
 		t.Fatal(v.Time, "!=", v2.Time)
 	}
 }
+
+func TestWrapError(t *testing.T) {
+	timeout := errors.New("timeout")
+	err := WrapError(ErrTransient, fmt.Errorf("Connection lost: %w", timeout))
+	if !errors.Is(err, ErrTransient) || !errors.Is(err, timeout) {
+		t.Fatal("errors.Is must match the kind and the wrapped errors")
+	}
+	if errors.Is(err, ErrNotFound) {
+		t.Fatal("Unexpected match")
+	}
+	if err.Error() != "Connection lost: timeout" {
+		t.Fatal(err.Error())
+	}
+	if WrapError(ErrTransient, nil) != nil {
+		t.Fatal("Expected nil")
+	}
+}
+
+func TestVersionMetadata(t *testing.T) {
+	// VERSION files written by older releases only have a name and a time
+	v, err := DeserializeVersion([]byte(`{"Name":"asd","Time":"2020-03-07T00:13:52Z"}`))
+	if err != nil || v.Name != "asd" || v.Git != nil || v.Meta != nil {
+		t.Fatal(v, err)
+	}
+	b, err := v.Serialize()
+	if err != nil || string(b) != `{"Name":"asd","Time":"2020-03-07T00:13:52Z"}` {
+		t.Fatal(string(b), err)
+	}
+
+	v.User = "me"
+	v.Git = &GitInfo{Commit: "abc", Branch: "main", Dirty: true}
+	v.Meta = map[string]string{"ticket": "123"}
+	b, err = v.Serialize()
+	if err != nil {
+		t.Fatal(err)
+	}
+	v2, err := DeserializeVersion(b)
+	if err != nil || v2.User != "me" || *v2.Git != *v.Git || v2.Meta["ticket"] != "123" {
+		t.Fatal(v2, err)
+	}
+}